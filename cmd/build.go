@@ -2,8 +2,10 @@ package cmd
 
 import (
 	"fmt"
+	"io"
+	"net/url"
 	"os"
-	"os/exec"
+	"path/filepath"
 	"strings"
 	"time"
 
@@ -64,62 +66,144 @@ func build() {
 	logger.Debug("Setup name for container")
 	containerName = fmt.Sprintf("%s:%s", Config.Name, dockerTag)
 
+	logger.Debug("Setup labels for the container")
+	labels, err = buildLabels()
+	if err != nil {
+		utils.ErrorAndQuit("Error looking up the git SHA", err, 2)
+	}
+
+	logger.Debug("Building container")
+	if err := buildContainer(containerName, dockerfile, dockerBuildArgs, labels); err != nil {
+		utils.ErrorAndQuit("Unable to build service container", err, 4)
+	}
+
+}
+
+// Returns the labels every container is built with: the commit, the build
+// date, what the CI system knows about the run and the static labels from the
+// config.
+func buildLabels() ([]string, error) {
+	var labels []string
+
 	logger.Debug("Looking up SHA for the HEAD of the repo")
 	headSHA, err := utils.GitSHA("HEAD")
 	if err != nil {
-		utils.ErrorAndQuit("Error looking up the git SHA", err, 2)
+		return nil, err
 	}
 
-	logger.Debug("Setup labels for the container")
 	labels = append(labels, fmt.Sprintf("%s=%s", utils.CommitLabel, headSHA))
 	labels = append(labels, fmt.Sprintf("%s=%s", utils.BuildDateLabel, time.Now().Format(utils.BuildDateFormat)))
+	labels = append(labels, utils.DetectCI().Labels()...)
 	if len(Config.Labels) > 0 {
 		for _, label := range Config.Labels {
 			labels = append(labels, label)
 		}
 	}
 
-	logger.Debug("Building container")
-	if err := buildContainer(containerName, dockerfile, dockerBuildArgs, labels); err != nil {
-		utils.ErrorAndQuit("Unable to build service container", err, 4)
-	}
-
+	return labels, nil
 }
 
 func buildContainer(containerName, dockerfile, dockerBuildArgs string, labels []string) error {
-	logger.Debug("Setup docker build command arguments")
-	buildCmdArgs := []string{"build", "-t", containerName}
-	for _, label := range labels {
-		buildCmdArgs = append(buildCmdArgs, "--label", label)
+	var output io.Writer
+
+	logger.Debug("Setup docker build options")
+	options, err := parseDockerBuildArgs(dockerBuildArgs)
+	if err != nil {
+		return err
 	}
+	options.Tag = containerName
 
-	if len(dockerBuildArgs) > 0 {
-		for _, arg := range strings.Split(dockerBuildArgs, " ") {
-			buildCmdArgs = append(buildCmdArgs, arg)
+	options.Labels = make(map[string]string)
+	for _, label := range labels {
+		kv := strings.SplitN(label, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("Label %s is not of the form <key>=<value>", label)
 		}
+		options.Labels[kv[0]] = kv[1]
 	}
 
-	buildCmdArgs = append(buildCmdArgs, "-f", dockerfile, ".")
-
-	dockerCmd, err := exec.LookPath("docker")
+	contextDir, err := filepath.Abs(".")
 	if err != nil {
-		return fmt.Errorf("Could not find docker executable")
+		return err
 	}
-	logger.Debug("Creating docker build command")
-	buildCmd := exec.Command(dockerCmd, buildCmdArgs...)
-	if DebugOutput || DockerOutput {
-		logger.Debug("Setting docker build output and errors to os.Stderr")
-		buildCmd.Stdout = os.Stderr
-		buildCmd.Stderr = os.Stderr
+	options.Dockerfile, err = filepath.Rel(contextDir, dockerfile)
+	if err != nil {
+		return err
+	}
+	options.Dockerfile = filepath.ToSlash(options.Dockerfile)
+
+	client, err := utils.GetDockerClient()
+	if err != nil {
+		return err
 	}
 
-	logger.Debug("Running docker build command")
-	err = buildCmd.Run()
+	logger.Debug("Creating docker build context")
+	buildContext, err := utils.TarBuildContext(contextDir, options.Dockerfile)
 	if err != nil {
 		return err
 	}
+	defer buildContext.Close()
+
+	if DebugOutput || DockerOutput {
+		logger.Debug("Setting docker build output to os.Stderr")
+		output = os.Stderr
+	}
+
+	logger.Debug("Running docker build")
+	return client.ImageBuild(buildContext, options, output)
+}
+
+// Converts the extra docker build arguments from the command line into
+// options for the Docker Engine API.
+func parseDockerBuildArgs(dockerBuildArgs string) (utils.BuildOptions, error) {
+	options := utils.BuildOptions{
+		BuildArgs: make(map[string]string),
+		Args:      url.Values{},
+	}
+
+	args := strings.Fields(dockerBuildArgs)
+	for i := 0; i < len(args); i++ {
+		flag, value := args[i], ""
+		hasValue := false
+		if kv := strings.SplitN(flag, "=", 2); len(kv) == 2 {
+			flag, value, hasValue = kv[0], kv[1], true
+		}
+
+		switch flag {
+		case "--no-cache":
+			options.Args.Set("nocache", "1")
+		case "--pull":
+			options.Args.Set("pull", "1")
+		case "--force-rm":
+			options.Args.Set("forcerm", "1")
+		case "--build-arg", "--target", "--network":
+			if !hasValue {
+				if i+1 >= len(args) {
+					return options, fmt.Errorf("Docker build argument %s requires a value", flag)
+				}
+				i++
+				value = args[i]
+			}
+
+			switch flag {
+			case "--build-arg":
+				kv := strings.SplitN(value, "=", 2)
+				if len(kv) == 2 {
+					options.BuildArgs[kv[0]] = kv[1]
+				} else {
+					options.BuildArgs[kv[0]] = os.Getenv(kv[0])
+				}
+			case "--target":
+				options.Args.Set("target", value)
+			case "--network":
+				options.Args.Set("networkmode", value)
+			}
+		default:
+			return options, fmt.Errorf("Unsupported docker build argument: %s", args[i])
+		}
+	}
 
-	return nil
+	return options, nil
 }
 
 func findDockerfile(repoToplvl string) (string, error) {
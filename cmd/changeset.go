@@ -0,0 +1,165 @@
+package cmd
+
+import (
+	"build_tool/utils"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+)
+
+// Change sets are usually ready within seconds
+const changeSetTimeout = 10 * time.Minute
+
+var errNoChanges = errors.New("No updates are to be performed")
+
+// Creates a change set for the stack update and prints the resource changes
+// it would make. If executeChangeSet is set the user is asked to confirm
+// before the change set is executed. Returns true if the change set was
+// executed. Change sets that aren't executed are deleted.
+func planStack(stackName string, template stackTemplate, parameters []*cloudformation.Parameter, options stackOptions, executeChangeSet bool, cf *cloudformation.CloudFormation) (bool, error) {
+	changeSetName := fmt.Sprintf("build-tool-%d", time.Now().Unix())
+
+	logger.Debugf("Creating change set %s", changeSetName)
+	_, err := cf.CreateChangeSet(&cloudformation.CreateChangeSetInput{
+		ChangeSetName:    aws.String(changeSetName),
+		StackName:        aws.String(stackName),
+		Parameters:       parameters,
+		TemplateBody:     template.Body,
+		TemplateURL:      template.URL,
+		Tags:             options.Tags,
+		Capabilities:     options.Capabilities,
+		NotificationARNs: options.NotificationARNs,
+	})
+	if err != nil {
+		return false, err
+	}
+
+	changes, err := waitForChangeSet(stackName, changeSetName, defaultSleepTime, cf)
+	if err != nil {
+		deleteChangeSet(stackName, changeSetName, cf)
+		return false, err
+	}
+
+	printChanges(changes)
+
+	if !executeChangeSet || !utils.Confirm(fmt.Sprintf("Execute change set %s on %s?", changeSetName, stackName)) {
+		return false, deleteChangeSet(stackName, changeSetName, cf)
+	}
+
+	// Change sets can't carry a stack policy, so it's set before the
+	// update starts
+	if options.StackPolicyBody != nil {
+		logger.Debug("Setting the stack policy")
+		_, err = cf.SetStackPolicy(&cloudformation.SetStackPolicyInput{
+			StackName:       aws.String(stackName),
+			StackPolicyBody: options.StackPolicyBody,
+		})
+		if err != nil {
+			deleteChangeSet(stackName, changeSetName, cf)
+			return false, fmt.Errorf("Unable to set the stack policy: %s", err)
+		}
+	}
+
+	logger.Debugf("Executing change set %s", changeSetName)
+	_, err = cf.ExecuteChangeSet(&cloudformation.ExecuteChangeSetInput{
+		ChangeSetName: aws.String(changeSetName),
+		StackName:     aws.String(stackName),
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Waits for a change set to finish being created and returns all of its
+// changes. Gives up after changeSetTimeout.
+func waitForChangeSet(stackName, changeSetName string, sleepTime int, cf *cloudformation.CloudFormation) ([]*cloudformation.Change, error) {
+	var (
+		changes   []*cloudformation.Change
+		nextToken *string
+	)
+
+	deadline := time.Now().Add(changeSetTimeout)
+	for {
+		resp, err := cf.DescribeChangeSet(&cloudformation.DescribeChangeSetInput{
+			ChangeSetName: aws.String(changeSetName),
+			StackName:     aws.String(stackName),
+			NextToken:     nextToken,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		switch aws.StringValue(resp.Status) {
+		case cloudformation.ChangeSetStatusFailed:
+			reason := aws.StringValue(resp.StatusReason)
+			if strings.Contains(reason, "didn't contain changes") || strings.Contains(reason, "No updates are to be performed") {
+				return nil, errNoChanges
+			}
+			return nil, fmt.Errorf("Failed to create change set: %s", reason)
+		case cloudformation.ChangeSetStatusCreateComplete:
+			changes = append(changes, resp.Changes...)
+			if resp.NextToken == nil {
+				return changes, nil
+			}
+			nextToken = resp.NextToken
+			continue
+		case cloudformation.ChangeSetStatusCreatePending, cloudformation.ChangeSetStatusCreateInProgress:
+		default:
+			return nil, fmt.Errorf("Change set %s is %s", changeSetName, aws.StringValue(resp.Status))
+		}
+
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("Timed out after %s waiting for change set %s", changeSetTimeout, changeSetName)
+		}
+		time.Sleep(time.Duration(sleepTime) * time.Second)
+	}
+}
+
+func deleteChangeSet(stackName, changeSetName string, cf *cloudformation.CloudFormation) error {
+	logger.Debugf("Deleting change set %s", changeSetName)
+	_, err := cf.DeleteChangeSet(&cloudformation.DeleteChangeSetInput{
+		ChangeSetName: aws.String(changeSetName),
+		StackName:     aws.String(stackName),
+	})
+
+	return err
+}
+
+func printChanges(changes []*cloudformation.Change) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ACTION\tLOGICAL ID\tPHYSICAL ID\tTYPE\tREPLACEMENT")
+
+	for _, change := range changes {
+		rc := change.ResourceChange
+		if rc == nil {
+			continue
+		}
+
+		replacement := aws.StringValue(rc.Replacement)
+		if replacement == "" {
+			replacement = "-"
+		}
+		physicalId := aws.StringValue(rc.PhysicalResourceId)
+		if physicalId == "" {
+			physicalId = "-"
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+			aws.StringValue(rc.Action),
+			aws.StringValue(rc.LogicalResourceId),
+			physicalId,
+			aws.StringValue(rc.ResourceType),
+			replacement,
+		)
+	}
+
+	w.Flush()
+}
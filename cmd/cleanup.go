@@ -2,11 +2,7 @@ package cmd
 
 import (
 	"build_tool/utils"
-	"bytes"
 	"fmt"
-	"log"
-	"os/exec"
-	"strings"
 
 	"github.com/spf13/cobra"
 )
@@ -75,10 +71,9 @@ func cleanUpUsingLabel(label string) error {
 			return fmt.Errorf("Unable to build commit label: %s", err.Error())
 		}
 	}
-	filterLabel := fmt.Sprintf("label=%s", label)
-	log.Println(filterLabel)
+	logger.Debugf("Cleaning up images with label %s", label)
 
-	if err := utils.CleanUpByLabel(filterLabel); err != nil {
+	if err := utils.CleanUpByLabel(label); err != nil {
 		return fmt.Errorf("Failed to clean up built containers: %s", err.Error())
 	}
 
@@ -86,35 +81,20 @@ func cleanUpUsingLabel(label string) error {
 }
 
 func cleanUpUsingName(container string) error {
-	var (
-		containerNamesArgs = []string{"inspect", "--format='{{ .RepoTags }}'"}
-		output             bytes.Buffer
-		containerNames     []string
-	)
-
-	containerNamesArgs = append(containerNamesArgs, container)
-
-	dockerCmd, err := exec.LookPath("docker")
+	client, err := utils.GetDockerClient()
 	if err != nil {
-		return fmt.Errorf("Could not find docker command: %s", err)
+		return err
 	}
 
-	containerNamesCmd := exec.Command(dockerCmd, containerNamesArgs...)
-	containerNamesCmd.Stdout = &output
-
-	if err := containerNamesCmd.Run(); err != nil {
+	image, err := client.ImageInspect(container)
+	if err != nil {
 		return fmt.Errorf("Error attempting to get all tags for container: %s", err.Error())
 	}
+	logger.Debug(image.RepoTags)
 
-	containerNames = strings.Split(strings.Trim(strings.TrimSpace(output.String()), "'[]"), " ")
-	logger.Debug(containerNames)
-
-	for _, name := range containerNames {
+	for _, name := range image.RepoTags {
 		logger.Debugf("Removing container: %s", name)
-		rmCmdArgs := []string{"rmi", name}
-
-		rmCmd := exec.Command(dockerCmd, rmCmdArgs...)
-		if err := rmCmd.Run(); err != nil {
+		if err := client.ImageRemove(name, false); err != nil {
 			return fmt.Errorf("Error removing container %s: %s", name, err.Error())
 		}
 	}
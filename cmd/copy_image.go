@@ -0,0 +1,92 @@
+package cmd
+
+import (
+	"build_tool/utils"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	copyFromEnv string
+	copyToEnv   string
+)
+
+func init() {
+	copyImageCli.Flags().StringVar(&copyFromEnv, "from-env", "", "environment whose credentials are used for the source registry. Default: the default credentials")
+	copyImageCli.Flags().StringVar(&copyToEnv, "to-env", "", "environment whose credentials are used for the destination registry. Default: the default credentials")
+	RootCmd.AddCommand(copyImageCli)
+}
+
+var copyImageCli = &cobra.Command{
+	Use:   "copy-image <source> <destination>",
+	Short: "Copies an image between registries",
+	Long:  `Copies an image, its layers and its manifest, from one registry or region to another using the registry API. The destination can be a full image name or just a registry, in which case the source's repository and tag are kept`,
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		CmdSetup()
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 2 {
+			utils.ErrorAndQuit("copy-image needs a source and a destination", nil, 1)
+		}
+		copyImage(args[0], args[1])
+	},
+}
+
+func copyImage(source, destination string) {
+	destination = copyDestination(source, destination)
+
+	digest, err := copyImageBetweenEnvs(source, destination, copyFromEnv, copyToEnv)
+	if err != nil {
+		utils.ErrorAndQuit(fmt.Sprintf("Unable to copy %s to %s", source, destination), err, 4)
+	}
+
+	fmt.Fprintf(os.Stderr, "Copied %s to %s (%s)\n", source, destination, digest)
+	fmt.Println(destination)
+}
+
+// Returns the full destination name. A destination without a repository is a
+// registry, and the image keeps its repository and tag there.
+func copyDestination(source, destination string) string {
+	if strings.Contains(destination, "/") {
+		return destination
+	}
+
+	repo, reference := utils.RegistryRepository(source)
+	if strings.HasPrefix(reference, "sha256:") {
+		return fmt.Sprintf("%s/%s@%s", destination, repo, reference)
+	}
+	return fmt.Sprintf("%s/%s:%s", destination, repo, reference)
+}
+
+// Copies an image using each environment's credentials for its registry.
+// Empty environments use the default credentials.
+func copyImageBetweenEnvs(source, destination, sourceEnv, destinationEnv string) (string, error) {
+	src, err := utils.GetEnvRegistryClient(source, Profile, copyEnvConfig(sourceEnv))
+	if err != nil {
+		return "", err
+	}
+
+	dst, err := utils.GetEnvRegistryClient(destination, Profile, copyEnvConfig(destinationEnv))
+	if err != nil {
+		return "", err
+	}
+
+	return utils.CopyImage(src, dst, source, destination, os.Stderr)
+}
+
+// Looks up the config of the environment whose credentials are used for a
+// registry. Quits with an error if the environment isn't in the config.
+func copyEnvConfig(env string) utils.EnvConfig {
+	if env == "" {
+		return utils.EnvConfig{}
+	}
+
+	envConfig, ok := Config.Envs[env]
+	if !ok {
+		utils.ErrorAndQuit(fmt.Sprintf("Environment %s is not in the config", env), nil, 3)
+	}
+	return envConfig
+}
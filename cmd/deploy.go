@@ -2,53 +2,198 @@ package cmd
 
 import (
 	"build_tool/utils"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/aws/aws-sdk-go/service/ecs"
 	"github.com/spf13/cobra"
 )
 
 var (
-	container string
-	newStack  bool
+	container        string
+	newStack         bool
+	planDeploy       bool
+	executeChangeSet bool
+	deployTimeout    time.Duration
+	deployOutputs    string
+	deployOutFormat  string
 )
 
 const defaultSleepTime = 5
 
+var errDeployTimeout = errors.New("Timed out waiting for the deploy to finish")
+
 func init() {
 	deployCli.Flags().StringVarP(&container, "container", "c", "", "container to use for deploy")
 	deployCli.Flags().BoolVarP(&newStack, "new-stack", "n", false, "create a new stack if one does not exist")
+	deployCli.Flags().BoolVar(&planDeploy, "plan", false, "show the changes a deploy would make using a change set")
+	deployCli.Flags().BoolVar(&executeChangeSet, "execute-change-set", false, "execute the planned change set after confirmation")
+	deployCli.Flags().DurationVar(&deployTimeout, "timeout", 0, "cancel the deploy if it takes longer than this. Default: the env's timeout setting")
+	deployCli.Flags().StringVar(&deployOutputs, "outputs-file", "", "write the stack's outputs to this file after the deploy")
+	deployCli.Flags().StringVar(&deployOutFormat, "outputs-format", outputsFormatDotenv, "format of the outputs file, one of dotenv, json or github")
 	RootCmd.AddCommand(deployCli)
 }
 
 var deployCli = &cobra.Command{
 	Use:   "deploy",
-	Short: "Deploy an ECR service with Cloudformation",
-	Long:  `Deploy an ECR service with Cloudformation`,
+	Short: "Deploy an ECR service with Cloudformation or directly to ECS",
+	Long:  `Deploy an ECR service with Cloudformation or directly to ECS`,
 	Run: func(cmd *cobra.Command, args []string) {
 		deploy()
 	},
 }
 
 func deploy() {
-	var parameters []*cloudformation.Parameter
+	if deployCurrent() == errNoChanges {
+		utils.Exit(255)
+	}
+}
+
+// Deploys the container to the current environment and writes the stack's
+// outputs. Returns errNoChanges if the stack was already up to date, and
+// quits with an error if the deploy fails.
+func deployCurrent() error {
+	if deployOutputs != "" && !validOutputsFormat(deployOutFormat) {
+		utils.ErrorAndQuit(fmt.Sprintf("Unknown outputs format %s", deployOutFormat), nil, 1)
+	}
 
 	sess, err := utils.GetAWSSession(Region, Profile)
 	if err != nil {
 		utils.ErrorAndQuit("Error getting AWS Session", err, 3)
 	}
 
-	cf := cloudformation.New(sess)
+	envSess, err := envAWSSession(AppEnv)
+	if err != nil {
+		utils.ErrorAndQuit("Error getting AWS Session for the environment", err, 3)
+	}
 
 	stackName := fmt.Sprintf("%s-%s", AppEnv, Config.Stack)
 
-	_, err = cf.DescribeStacks(&cloudformation.DescribeStacksInput{
+	var source string
+	container, source, err = findContainer(container, Config.EcrRepo, Config.Name, AppEnv, sess)
+	if err != nil {
+		utils.ErrorAndQuit("No container provided and could not find container", err, 5)
+	}
+
+	// The changelog is only informational so problems building it don't stop
+	// the deploy
+	logger.Debug("Building the changelog")
+	if cl, err := buildChangelog(AppEnv, stackName, changelogImage(container, source), envSess); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to build the changelog: %s\n", err)
+	} else {
+		printChangelog(os.Stderr, cl, false)
+		fmt.Fprintln(os.Stderr)
+	}
+
+	if source != "" {
+		if err := copyPromotedImage(source, container); err != nil {
+			utils.ErrorAndQuit("Unable to copy the container to the environment's registry", err, 4)
+		}
+	}
+
+	err = deployContainer(stackName, container, envSess)
+	if err == errNoChanges {
+		logger.Info("Nothing to update")
+	}
+
+	if deployOutputs != "" {
+		logger.Debugf("Writing the stack's outputs to %s", deployOutputs)
+		if err := exportOutputs(stackName, deployOutputs, deployOutFormat, cloudformation.New(envSess)); err != nil {
+			utils.ErrorAndQuit("Deploy succeeded but the stack's outputs could not be written", err, 5)
+		}
+	}
+
+	return err
+}
+
+// Deploys the given container to the current environment using the
+// environment's deploy mode and waits for the deploy to finish. Quits with an
+// error if the deploy fails. Returns errNoChanges if the stack was already
+// up to date.
+//
+// When the environment has health checks they are run once the deploy has
+// finished. If a check fails the container that was running before the deploy
+// is redeployed and the deploy quits with an error.
+func deployContainer(stackName, container string, sess *session.Session) error {
+	envConfig := Config.Envs[AppEnv]
+
+	if deployTimeout == 0 {
+		deployTimeout = envConfig.Timeout.Duration
+	}
+
+	release := acquireDeployLock(stackName, fmt.Sprintf("deploying %s", container), sess)
+	defer release()
+
+	var previous string
+	if len(envConfig.HealthChecks) > 0 {
+		var err error
+		logger.Debug("Looking up the running container in case of a rollback")
+		if previous, err = deployedContainer(stackName, envConfig, sess); err != nil {
+			logger.Debugf("No running container found: %s", err)
+		}
+	}
+
+	deployed, err := rollOut(stackName, container, envConfig, sess)
+	if !deployed || len(envConfig.HealthChecks) == 0 {
+		return err
+	}
+
+	err = runHealthChecks(stackName, envConfig, sess)
+	if err == nil {
+		return nil
+	}
+
+	if previous == "" || previous == container {
+		utils.ErrorAndQuit("Health checks failed and there is no previous container to roll back to", err, 10)
+	}
+
+	fmt.Fprintf(os.Stderr, "Health checks failed: %s\nRolling back to %s\n", err, previous)
+	planDeploy = false
+	rollOut(stackName, previous, envConfig, sess)
+
+	utils.ErrorAndQuit("Deploy failed its health checks and was rolled back", err, 10)
+	return nil
+}
+
+// Deploys a container with the environment's deploy mode. Returns false if
+// nothing was deployed because a planned change set wasn't executed, or
+// false and errNoChanges if the stack was already up to date.
+func rollOut(stackName, container string, envConfig utils.EnvConfig, sess *session.Session) (bool, error) {
+	switch envConfig.DeployMode {
+	case "", utils.DeployModeCloudformation:
+		cf := cloudformation.New(sess)
+		resolver := utils.NewParameterResolver(sess)
+		operationStart, err := deployStack(stackName, container, resolver, cf, sess)
+		if err != nil || operationStart.IsZero() {
+			return false, err
+		}
+		waitForStackServices(stackName, operationStart, envConfig, cf, ecs.New(sess))
+	case utils.DeployModeECS:
+		if planDeploy {
+			utils.ErrorAndQuit("Changes can only be planned for Cloudformation deploys", nil, 3)
+		}
+		deployService(stackName, container, envConfig, ecs.New(sess))
+	default:
+		utils.ErrorAndQuit(fmt.Sprintf("Unknown deploy mode %s", envConfig.DeployMode), nil, 3)
+	}
+
+	return true, nil
+}
+
+// Creates or updates the stack to run the given container and waits for the
+// stack operation to finish. Returns when the stack operation started, or the
+// zero time if the stack wasn't changed. Returns errNoChanges if the stack is
+// already up to date.
+func deployStack(stackName, container string, resolver *utils.ParameterResolver, cf *cloudformation.CloudFormation, sess *session.Session) (time.Time, error) {
+	_, err := cf.DescribeStacks(&cloudformation.DescribeStacksInput{
 		StackName: aws.String(stackName),
 	})
 	if err != nil && strings.Contains(err.Error(), "does not exist") {
@@ -57,81 +202,231 @@ func deploy() {
 		utils.ErrorAndQuit("Error checking the stack's status", err, 5)
 	}
 
-	container, err = findContainer(container, Config.EcrRepo, Config.Name, AppEnv, sess)
+	if Config.CFTemplate == "" {
+		utils.ErrorAndQuit("No CF template set", nil, 3)
+	}
+
+	template, err := readTemplate(Config.CFTemplate, artifactBucket(Config, AppEnv), sess)
 	if err != nil {
-		utils.ErrorAndQuit("No container provided and could not find container", err, 5)
+		utils.ErrorAndQuit("Unable to read the CF template", err, 3)
 	}
 
-	if Config.CFTemplate == "" {
-		utils.ErrorAndQuit("No CF template set", nil, 3)
+	logger.Debug("Validating the template")
+	templateParameters, err := getTemplateParameters(template, cf)
+	if err != nil {
+		utils.ErrorAndQuit("Cloudformation template is not valid", err, 3)
 	}
 
-	parameters = setupParameters(container, Config)
+	parameters, err := setupParameters(container, Config, templateParameters, resolver)
+	if err != nil {
+		utils.ErrorAndQuit("Cloudformation parameters do not match the template", err, 3)
+	}
 
-	err = launchStack(newStack, stackName, Config.CFTemplate, parameters, cf)
-	if err != nil && strings.Contains(err.Error(), "No updates are to be performed") {
-		logger.Info("Nothing to update")
-		os.Exit(255)
-	} else if err != nil {
-		utils.ErrorAndQuit("Unable to setup stack", err, 6)
+	options, err := newStackOptions(AppEnv, Config.Envs[AppEnv])
+	if err != nil {
+		utils.ErrorAndQuit("Unable to setup the stack's settings", err, 3)
+	}
+
+	var operationStart time.Time
+	if planDeploy {
+		if newStack {
+			utils.ErrorAndQuit("Changes can only be planned for an existing stack", nil, 3)
+		}
+
+		executed, err := planStack(stackName, template, parameters, options, executeChangeSet, cf)
+		if err == errNoChanges {
+			return time.Time{}, err
+		} else if err != nil {
+			utils.ErrorAndQuit("Unable to plan stack update", err, 6)
+		}
+
+		if !executed {
+			return time.Time{}, nil
+		}
+		operationStart = time.Now()
 	} else {
-		if err = watchStack(stackName, defaultSleepTime, cf); err != nil {
-			utils.ErrorAndQuit("Stack creation/update was not successful", err, 7)
+		operationStart = time.Now()
+		err = launchStack(newStack, stackName, template, parameters, options, cf)
+		if err != nil && strings.Contains(err.Error(), "No updates are to be performed") {
+			return time.Time{}, errNoChanges
+		} else if err != nil {
+			utils.ErrorAndQuit("Unable to setup stack", err, 6)
 		}
 	}
+
+	err = watchStack(stackName, operationStart, deployTimeout, defaultSleepTime, cf)
+	if err == errDeployTimeout {
+		utils.ErrorAndQuit("Stack creation/update did not finish in time", err, 8)
+	} else if err != nil {
+		utils.ErrorAndQuit("Stack creation/update was not successful", err, 7)
+	}
+
+	if options.TerminationProtection != nil {
+		err = utils.SetTerminationProtection(stackName, *options.TerminationProtection, cf)
+		if err != nil {
+			logger.Warnf("Stack was deployed but termination protection was not updated: %s", err)
+		}
+	}
+
+	return operationStart, nil
 }
 
-func setupParameters(name string, config utils.Config) []*cloudformation.Parameter {
-	var parameters []*cloudformation.Parameter
+// Waits for the ECS services in a stack to reach a steady state. Cloudformation
+// can finish updating a stack while ECS is still replacing the old tasks.
+// Quits with an error if a service doesn't become stable.
+func waitForStackServices(stackName string, since time.Time, envConfig utils.EnvConfig, cf *cloudformation.CloudFormation, ecsClient *ecs.ECS) {
+	logger.Debug("Looking up ECS services in the stack")
+	cluster, services, err := findStackServices(stackName, envConfig, cf)
+	if err != nil {
+		utils.ErrorAndQuit("Unable to look up the stack's services", err, 7)
+	}
 
+	for _, service := range services {
+		logger.Debugf("Waiting for service %s to become stable", service)
+		err = waitForService(cluster, service, since, deployTimeout, defaultSleepTime, ecsClient)
+		if err == errDeployTimeout {
+			utils.ErrorAndQuit(fmt.Sprintf("Service %s did not become stable in time", service), err, 8)
+		} else if err != nil {
+			utils.ErrorAndQuit(fmt.Sprintf("Service %s did not become stable", service), err, 7)
+		}
+	}
+}
+
+// Builds the Cloudformation parameters for the current environment from the
+// config, resolving any references in the values. ImageID and TaskName are
+// filled in when the template declares them. Every problem found when checking
+// the parameters against the template's parameters is reported in a single
+// error.
+func setupParameters(name string, config utils.Config, templateParameters []*cloudformation.TemplateParameter, resolver *utils.ParameterResolver) ([]*cloudformation.Parameter, error) {
+	var (
+		parameters []*cloudformation.Parameter
+		problems   []string
+	)
+
+	declared := make(map[string]*cloudformation.TemplateParameter)
+	for _, templateParameter := range templateParameters {
+		declared[aws.StringValue(templateParameter.ParameterKey)] = templateParameter
+	}
+
+	supplied := make(map[string]bool)
 	for _, val := range config.CFParameters[AppEnv] {
-		parameter := strings.Split(val, "=")
+		parameter := strings.SplitN(val, "=", 2)
+		if len(parameter) != 2 {
+			problems = append(problems, fmt.Sprintf("%s is not of the form <key>=<value>", val))
+			continue
+		}
+
+		key := strings.TrimSpace(parameter[0])
+		if supplied[key] {
+			problems = append(problems, fmt.Sprintf("%s is set more than once", key))
+			continue
+		} else if _, ok := declared[key]; !ok {
+			problems = append(problems, fmt.Sprintf("%s is not a parameter of the template", key))
+			continue
+		}
+		supplied[key] = true
+
+		value, sensitive, err := resolver.Resolve(parameter[1])
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s could not be resolved: %s", key, err))
+			continue
+		}
+
+		if sensitive {
+			logger.Debugf("Parameter %s resolved from %s", key, parameter[1])
+		} else {
+			logger.Debugf("Parameter %s=%s", key, value)
+		}
+
 		parameters = append(parameters, &cloudformation.Parameter{
-			ParameterKey:   aws.String(parameter[0]),
-			ParameterValue: aws.String(parameter[1]),
+			ParameterKey:   aws.String(key),
+			ParameterValue: aws.String(value),
 		})
 	}
 
-	parameters = append(parameters, &cloudformation.Parameter{
-		ParameterKey:   aws.String("ImageID"),
-		ParameterValue: aws.String(container),
-	})
+	automatic := map[string]string{
+		"ImageID":  name,
+		"TaskName": fmt.Sprintf("%s-%s", AppEnv, config.Stack),
+	}
+	for _, key := range []string{"ImageID", "TaskName"} {
+		if _, ok := declared[key]; ok && !supplied[key] {
+			supplied[key] = true
+			parameters = append(parameters, &cloudformation.Parameter{
+				ParameterKey:   aws.String(key),
+				ParameterValue: aws.String(automatic[key]),
+			})
+		}
+	}
+
+	for _, templateParameter := range templateParameters {
+		key := aws.StringValue(templateParameter.ParameterKey)
+		if templateParameter.DefaultValue == nil && !supplied[key] {
+			problems = append(problems, fmt.Sprintf("%s is required by the template but not set", key))
+		}
+	}
+
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("%d problems found:\n  %s", len(problems), strings.Join(problems, "\n  "))
+	}
+
+	return parameters, nil
+}
 
-	parameters = append(parameters, &cloudformation.Parameter{
-		ParameterKey:   aws.String("TaskName"),
-		ParameterValue: aws.String(fmt.Sprintf("%s-%s", AppEnv, config.Stack)),
+// Looks up the parameters declared by a Cloudformation template.
+func getTemplateParameters(template stackTemplate, cf *cloudformation.CloudFormation) ([]*cloudformation.TemplateParameter, error) {
+	resp, err := cf.ValidateTemplate(&cloudformation.ValidateTemplateInput{
+		TemplateBody: template.Body,
+		TemplateURL:  template.URL,
 	})
+	if err != nil {
+		return nil, err
+	}
 
-	return parameters
+	return resp.Parameters, nil
 }
 
-func findContainer(container, ecrRepo, name, env string, sess *session.Session) (string, error) {
+// Returns the container to deploy, which is the latest one the environment's
+// promotion rule allows when none is given. When the container is in the
+// environment's own registry and still has to be copied there, the image to
+// copy it from is returned too. Nothing is copied.
+func findContainer(container, ecrRepo, name, env string, sess *session.Session) (string, string, error) {
 	if container == "" {
-		latestBuildTag, err := utils.FindLatestBuildTag(ecrRepo, name, env, sess)
+		rule, err := Config.PromotionRule(env)
 		if err != nil {
-			return "", fmt.Errorf("Error looking up latest build tag")
+			return "", "", err
 		}
-		return fmt.Sprintf("%s/%s:%s", ecrRepo, name, latestBuildTag), nil
+
+		tag, err := utils.FindPromotionCandidate(ecrRepo, name, rule, sess)
+		if err != nil {
+			return "", "", err
+		}
+		return promotionImage(rule, tag), promotionSource(rule, tag), nil
 	}
 
-	return container, nil
+	return container, "", nil
+}
+
+// Returns the image to read a container's labels from. A container that
+// hasn't been copied to its registry yet has the same labels as its source.
+func changelogImage(container, source string) string {
+	if source != "" {
+		return source
+	}
+	return container
 }
 
-func launchStack(newStack bool, stackName, cfTemplate string, parameters []*cloudformation.Parameter, cf *cloudformation.CloudFormation) error {
+func launchStack(newStack bool, stackName string, template stackTemplate, parameters []*cloudformation.Parameter, options stackOptions, cf *cloudformation.CloudFormation) error {
 	if newStack {
 		stackInput := cloudformation.CreateStackInput{}
 
 		stackInput.Parameters = parameters
 		stackInput.StackName = aws.String(stackName)
-		if strings.Contains(Config.CFTemplate, "s3://") {
-			stackInput.TemplateURL = aws.String(cfTemplate)
-		} else {
-			contents, err := ioutil.ReadFile(cfTemplate)
-			if err != nil {
-				return err
-			}
-			stackInput.TemplateBody = aws.String(string(contents))
-		}
+		stackInput.TemplateBody = template.Body
+		stackInput.TemplateURL = template.URL
+		stackInput.Tags = options.Tags
+		stackInput.Capabilities = options.Capabilities
+		stackInput.NotificationARNs = options.NotificationARNs
+		stackInput.StackPolicyBody = options.StackPolicyBody
 
 		_, err := cf.CreateStack(&stackInput)
 		if err != nil {
@@ -142,15 +437,13 @@ func launchStack(newStack bool, stackName, cfTemplate string, parameters []*clou
 
 		stackInput.Parameters = parameters
 		stackInput.StackName = aws.String(stackName)
-		if strings.Contains(Config.CFTemplate, "s3://") {
-			stackInput.TemplateURL = aws.String(cfTemplate)
-		} else {
-			contents, err := ioutil.ReadFile(cfTemplate)
-			if err != nil {
-				return err
-			}
-			stackInput.TemplateBody = aws.String(string(contents))
-		}
+		stackInput.TemplateBody = template.Body
+		stackInput.TemplateURL = template.URL
+		stackInput.Tags = options.Tags
+		stackInput.Capabilities = options.Capabilities
+		stackInput.NotificationARNs = options.NotificationARNs
+		stackInput.StackPolicyBody = options.StackPolicyBody
+
 		_, err := cf.UpdateStack(&stackInput)
 		if err != nil {
 			return err
@@ -160,8 +453,129 @@ func launchStack(newStack bool, stackName, cfTemplate string, parameters []*clou
 	return nil
 }
 
-func watchStack(stackName string, sleepTime int, cf *cloudformation.CloudFormation) error {
-Loop:
+// Settings applied to a stack every time it is created or updated.
+// Termination protection is left alone when it's nil.
+type stackOptions struct {
+	Tags                  []*cloudformation.Tag
+	Capabilities          []*string
+	NotificationARNs      []*string
+	StackPolicyBody       *string
+	TerminationProtection *bool
+}
+
+// Builds the stack settings for an environment from its config. Termination
+// protection is turned on for prod unless the config says otherwise, and
+// isn't changed for other environments that don't set it.
+func newStackOptions(env string, envConfig utils.EnvConfig) (stackOptions, error) {
+	options := stackOptions{
+		Capabilities:          aws.StringSlice(envConfig.Capabilities),
+		NotificationARNs:      aws.StringSlice(envConfig.NotificationArns),
+		TerminationProtection: envConfig.TerminationProtection,
+	}
+
+	if options.TerminationProtection == nil && env == "prod" {
+		options.TerminationProtection = aws.Bool(true)
+	}
+
+	keys := make([]string, 0, len(envConfig.StackTags))
+	for key := range envConfig.StackTags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		options.Tags = append(options.Tags, &cloudformation.Tag{
+			Key:   aws.String(key),
+			Value: aws.String(envConfig.StackTags[key]),
+		})
+	}
+
+	if envConfig.StackPolicy != "" {
+		policy, err := ioutil.ReadFile(envConfig.StackPolicy)
+		if err != nil {
+			return options, fmt.Errorf("Unable to read stack policy: %s", err)
+		}
+		options.StackPolicyBody = aws.String(string(policy))
+	}
+
+	return options, nil
+}
+
+// A Cloudformation template passed either inline or by URL. Only one of the
+// fields is set.
+type stackTemplate struct {
+	Body *string
+	URL  *string
+}
+
+// Works out how to pass a Cloudformation template to Cloudformation.
+//
+// s3:// URIs are converted to the object's https URL. Local templates are
+// uploaded to the artifact bucket under a key based on their contents when a
+// bucket is configured, and are passed inline otherwise. Templates over the
+// inline size limit need an artifact bucket.
+func readTemplate(cfTemplate, bucket string, sess *session.Session) (stackTemplate, error) {
+	if utils.IsS3URI(cfTemplate) {
+		templateURL, err := utils.S3URIToURL(cfTemplate, sess)
+		if err != nil {
+			return stackTemplate{}, err
+		}
+		return stackTemplate{URL: aws.String(templateURL)}, nil
+	} else if strings.HasPrefix(cfTemplate, "https://") {
+		return stackTemplate{URL: aws.String(cfTemplate)}, nil
+	}
+
+	contents, err := ioutil.ReadFile(cfTemplate)
+	if err != nil {
+		return stackTemplate{}, err
+	}
+
+	if bucket == "" {
+		if len(contents) > utils.MaxTemplateBodySize {
+			return stackTemplate{}, fmt.Errorf("%s is %d bytes which is over Cloudformation's limit of %d. Set an artifact bucket to upload it to", cfTemplate, len(contents), utils.MaxTemplateBodySize)
+		}
+		return stackTemplate{Body: aws.String(string(contents))}, nil
+	}
+
+	key := utils.ArtifactKey(fmt.Sprintf("%s/templates", Config.Name), cfTemplate, contents)
+	logger.Debugf("Uploading %s to s3://%s/%s", cfTemplate, bucket, key)
+	templateURL, err := utils.UploadArtifact(bucket, key, contents, sess)
+	if err != nil {
+		return stackTemplate{}, err
+	}
+
+	return stackTemplate{URL: aws.String(templateURL)}, nil
+}
+
+// Returns the artifact bucket for an environment. The environment's own
+// bucket takes precedence over the global one.
+func artifactBucket(config utils.Config, env string) string {
+	if bucket := config.Envs[env].ArtifactBucket; bucket != "" {
+		return bucket
+	}
+
+	return config.ArtifactBucket
+}
+
+// Waits for a stack operation to finish, printing the stack's events as they
+// happen. Only events at or after since are shown. When the operation fails
+// the returned error includes the reasons of the failed resources.
+//
+// If timeout is set and the operation hasn't finished in time an update is
+// cancelled and rolled back, and errDeployTimeout is returned once the
+// rollback is done. Stack creations can't be cancelled so errDeployTimeout is
+// returned straight away.
+func watchStack(stackName string, since time.Time, timeout time.Duration, sleepTime int, cf *cloudformation.CloudFormation) error {
+	var (
+		failures  []*cloudformation.StackEvent
+		cancelled bool
+		deadline  time.Time
+	)
+	seen := make(map[string]bool)
+
+	if timeout > 0 {
+		deadline = since.Add(timeout)
+	}
+
 	for {
 		resp, err := cf.DescribeStacks(&cloudformation.DescribeStacksInput{
 			StackName: aws.String(stackName),
@@ -169,24 +583,157 @@ Loop:
 		if err != nil {
 			return err
 		}
+		status := aws.StringValue(resp.Stacks[0].StackStatus)
+
+		events, err := newStackEvents(stackName, since, seen, cf)
+		if err != nil {
+			return err
+		}
+
+		for _, event := range events {
+			printStackEvent(event)
+			if isRootCause(event) {
+				failures = append(failures, event)
+			}
+		}
 
-		switch aws.StringValue(resp.Stacks[0].StackStatus) {
-		case cloudformation.StackStatusCreateFailed:
-			return fmt.Errorf("Failed to create the stack")
-		case cloudformation.StackStatusRollbackFailed:
-			return fmt.Errorf("Failed to rollback the stack")
-		case cloudformation.StackStatusUpdateRollbackFailed:
-			return fmt.Errorf("Failed to rollback the stack update")
-		case cloudformation.StackStatusUpdateRollbackComplete:
-			return fmt.Errorf("Stack update failed and rolledback")
-		case cloudformation.StackStatusCreateComplete:
-			break Loop
-		case cloudformation.StackStatusUpdateComplete:
-			break Loop
+		done, failure := stackStatusResult(status, cancelled)
+		if done && cancelled && status == cloudformation.StackStatusUpdateRollbackComplete {
+			return errDeployTimeout
+		} else if done && failure != "" {
+			return stackFailure(failure, failures)
+		} else if done {
+			return nil
+		}
+
+		if !cancelled && !deadline.IsZero() && time.Now().After(deadline) {
+			if status != cloudformation.StackStatusUpdateInProgress {
+				fmt.Fprintf(os.Stderr, "Timed out after %s while the stack is %s\n", timeout, status)
+				return errDeployTimeout
+			}
+
+			fmt.Fprintf(os.Stderr, "Timed out after %s, cancelling the stack update\n", timeout)
+			if _, err := cf.CancelUpdateStack(&cloudformation.CancelUpdateStackInput{
+				StackName: aws.String(stackName),
+			}); err != nil {
+				return fmt.Errorf("Unable to cancel the stack update: %s", err)
+			}
+			cancelled = true
 		}
 
 		time.Sleep(time.Duration(sleepTime) * time.Second)
 	}
+}
 
-	return nil
+// Maps a stack status to whether the stack operation has finished and, if it
+// finished unsuccessfully, a description of the failure. Once an update has
+// been cancelled the rollback is waited on instead of being treated as the
+// end of the operation.
+func stackStatusResult(status string, cancelled bool) (bool, string) {
+	switch status {
+	case cloudformation.StackStatusCreateInProgress,
+		cloudformation.StackStatusUpdateInProgress:
+		return false, ""
+	case cloudformation.StackStatusCreateComplete,
+		cloudformation.StackStatusUpdateComplete,
+		cloudformation.StackStatusUpdateCompleteCleanupInProgress:
+		return true, ""
+	case cloudformation.StackStatusCreateFailed,
+		cloudformation.StackStatusRollbackInProgress,
+		cloudformation.StackStatusRollbackComplete:
+		return true, "Failed to create the stack"
+	case cloudformation.StackStatusRollbackFailed:
+		return true, "Failed to rollback the stack"
+	case cloudformation.StackStatusUpdateRollbackInProgress,
+		cloudformation.StackStatusUpdateRollbackCompleteCleanupInProgress:
+		if cancelled {
+			return false, ""
+		}
+		return true, "Stack update failed and is rolling back"
+	case cloudformation.StackStatusUpdateRollbackComplete:
+		return true, "Stack update failed and rolledback"
+	case cloudformation.StackStatusUpdateRollbackFailed:
+		return true, "Failed to rollback the stack update"
+	case cloudformation.StackStatusDeleteInProgress,
+		cloudformation.StackStatusDeleteComplete,
+		cloudformation.StackStatusDeleteFailed:
+		return true, fmt.Sprintf("Stack is being deleted (%s)", status)
+	}
+
+	return true, fmt.Sprintf("Unexpected stack status %s", status)
+}
+
+// Returns the stack events since the given time that haven't been seen yet
+// in the order they happened.
+func newStackEvents(stackName string, since time.Time, seen map[string]bool, cf *cloudformation.CloudFormation) ([]*cloudformation.StackEvent, error) {
+	var events []*cloudformation.StackEvent
+
+	params := &cloudformation.DescribeStackEventsInput{
+		StackName: aws.String(stackName),
+	}
+
+	// Events are returned newest first so stop paging at the first event that
+	// happened before the operation started
+	err := cf.DescribeStackEventsPages(params, func(page *cloudformation.DescribeStackEventsOutput, lastPage bool) bool {
+		for _, event := range page.StackEvents {
+			if aws.TimeValue(event.Timestamp).Before(since) {
+				return false
+			}
+			if seen[aws.StringValue(event.EventId)] {
+				continue
+			}
+			seen[aws.StringValue(event.EventId)] = true
+			events = append(events, event)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+		events[i], events[j] = events[j], events[i]
+	}
+
+	return events, nil
+}
+
+func printStackEvent(event *cloudformation.StackEvent) {
+	line := fmt.Sprintf("%s %-45s %-40s %s",
+		aws.TimeValue(event.Timestamp).Local().Format("2006-01-02 15:04:05"),
+		aws.StringValue(event.ResourceStatus),
+		aws.StringValue(event.ResourceType),
+		aws.StringValue(event.LogicalResourceId),
+	)
+	if reason := aws.StringValue(event.ResourceStatusReason); reason != "" {
+		line = fmt.Sprintf("%s: %s", line, reason)
+	}
+
+	fmt.Fprintln(os.Stderr, line)
+}
+
+// Checks if an event is the failure of a resource, ignoring resources that
+// were only cancelled because something else failed.
+func isRootCause(event *cloudformation.StackEvent) bool {
+	reason := aws.StringValue(event.ResourceStatusReason)
+
+	return strings.HasSuffix(aws.StringValue(event.ResourceStatus), "_FAILED") &&
+		reason != "" && !strings.Contains(reason, "cancelled")
+}
+
+func stackFailure(msg string, failures []*cloudformation.StackEvent) error {
+	if len(failures) == 0 {
+		return errors.New(msg)
+	}
+
+	reasons := []string{msg}
+	for _, event := range failures {
+		reasons = append(reasons, fmt.Sprintf("%s (%s): %s",
+			aws.StringValue(event.LogicalResourceId),
+			aws.StringValue(event.ResourceType),
+			aws.StringValue(event.ResourceStatusReason),
+		))
+	}
+
+	return errors.New(strings.Join(reasons, "\n  "))
 }
@@ -0,0 +1,359 @@
+package cmd
+
+import (
+	"build_tool/utils"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+const (
+	defaultCluster          = "default"
+	deploymentStatusPrimary = "PRIMARY"
+	maxStoppedTasks         = 3
+
+	// Tasks stopped by ECS to scale a service or replace it with a new
+	// deployment have a stopped reason starting with this
+	scalingStoppedReason = "Scaling activity initiated by"
+)
+
+// Registers a new revision of the service's task definition running the given
+// container, updates the service to use it and waits for the service to reach
+// a steady state. Quits with an error if the deploy fails.
+func deployService(stackName, container string, envConfig utils.EnvConfig, ecsClient *ecs.ECS) {
+	cluster := envConfig.Cluster
+	if cluster == "" {
+		cluster = defaultCluster
+	}
+
+	service := envConfig.Service
+	if service == "" {
+		service = stackName
+	}
+
+	logger.Debugf("Registering a task definition for %s", container)
+	taskDefinition, err := registerTaskDefinition(cluster, service, container, envConfig.ContainerName, ecsClient)
+	if err != nil {
+		utils.ErrorAndQuit("Unable to register a new task definition", err, 6)
+	}
+	fmt.Fprintf(os.Stderr, "Registered task definition %s\n", taskDefinition)
+
+	operationStart := time.Now()
+	_, err = ecsClient.UpdateService(&ecs.UpdateServiceInput{
+		Cluster:        aws.String(cluster),
+		Service:        aws.String(service),
+		TaskDefinition: aws.String(taskDefinition),
+	})
+	if err != nil {
+		utils.ErrorAndQuit("Unable to update the service", err, 6)
+	}
+
+	err = waitForService(cluster, service, operationStart, deployTimeout, defaultSleepTime, ecsClient)
+	if err == errDeployTimeout {
+		utils.ErrorAndQuit("Service update did not finish in time", err, 8)
+	} else if err != nil {
+		utils.ErrorAndQuit("Service update was not successful", err, 7)
+	}
+}
+
+// Copies the task definition currently used by a service, swapping the image
+// of the named container, and registers it as a new revision. Returns the ARN
+// of the new revision.
+func registerTaskDefinition(cluster, service, container, containerName string, ecsClient *ecs.ECS) (string, error) {
+	svc, err := describeService(cluster, service, ecsClient)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := ecsClient.DescribeTaskDefinition(&ecs.DescribeTaskDefinitionInput{
+		TaskDefinition: svc.TaskDefinition,
+		Include:        []*string{aws.String(ecs.TaskDefinitionFieldTags)},
+	})
+	if err != nil {
+		return "", err
+	}
+	taskDefinition := resp.TaskDefinition
+
+	containerDefinition, err := findContainerDefinition(taskDefinition.ContainerDefinitions, containerName)
+	if err != nil {
+		return "", err
+	}
+	containerDefinition.Image = aws.String(container)
+
+	registerResp, err := ecsClient.RegisterTaskDefinition(newTaskDefinitionInput(taskDefinition, resp.Tags))
+	if err != nil {
+		return "", err
+	}
+
+	return aws.StringValue(registerResp.TaskDefinition.TaskDefinitionArn), nil
+}
+
+// Builds the input to register a new revision of a task definition. Every
+// setting of the task definition is kept so a revision of a Fargate task
+// still has its execution role, CPU and memory.
+func newTaskDefinitionInput(taskDefinition *ecs.TaskDefinition, tags []*ecs.Tag) *ecs.RegisterTaskDefinitionInput {
+	input := &ecs.RegisterTaskDefinitionInput{
+		ContainerDefinitions:    taskDefinition.ContainerDefinitions,
+		Cpu:                     taskDefinition.Cpu,
+		ExecutionRoleArn:        taskDefinition.ExecutionRoleArn,
+		Family:                  taskDefinition.Family,
+		IpcMode:                 taskDefinition.IpcMode,
+		Memory:                  taskDefinition.Memory,
+		NetworkMode:             taskDefinition.NetworkMode,
+		PidMode:                 taskDefinition.PidMode,
+		PlacementConstraints:    taskDefinition.PlacementConstraints,
+		RequiresCompatibilities: taskDefinition.RequiresCompatibilities,
+		TaskRoleArn:             taskDefinition.TaskRoleArn,
+		Volumes:                 taskDefinition.Volumes,
+	}
+	if len(tags) > 0 {
+		input.Tags = tags
+	}
+
+	return input
+}
+
+// Finds the container definition with the given name. If no name is given
+// the task definition must only have a single container.
+func findContainerDefinition(definitions []*ecs.ContainerDefinition, name string) (*ecs.ContainerDefinition, error) {
+	var names []string
+
+	if name == "" && len(definitions) == 1 {
+		return definitions[0], nil
+	}
+
+	for _, definition := range definitions {
+		if aws.StringValue(definition.Name) == name {
+			return definition, nil
+		}
+		names = append(names, aws.StringValue(definition.Name))
+	}
+
+	if name == "" {
+		return nil, fmt.Errorf("Task definition has multiple containers, set container_name to one of: %s", strings.Join(names, ", "))
+	}
+
+	return nil, fmt.Errorf("Container %s not found in task definition, found: %s", name, strings.Join(names, ", "))
+}
+
+func describeService(cluster, service string, ecsClient *ecs.ECS) (*ecs.Service, error) {
+	resp, err := ecsClient.DescribeServices(&ecs.DescribeServicesInput{
+		Cluster:  aws.String(cluster),
+		Services: []*string{aws.String(service)},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp.Failures) > 0 {
+		return nil, fmt.Errorf("Unable to find service %s in cluster %s: %s", service, cluster, aws.StringValue(resp.Failures[0].Reason))
+	}
+	if len(resp.Services) == 0 {
+		return nil, fmt.Errorf("Unable to find service %s in cluster %s", service, cluster)
+	}
+
+	return resp.Services[0], nil
+}
+
+// Waits for a service to reach a steady state where the primary deployment is
+// the only deployment and it is running the desired number of tasks. Service
+// events since the given time are printed as they arrive. If tasks of the
+// primary deployment keep failing the error includes why they stopped.
+func waitForService(cluster, service string, since time.Time, timeout time.Duration, sleepTime int, ecsClient *ecs.ECS) error {
+	var deadline time.Time
+	seen := make(map[string]bool)
+
+	if timeout > 0 {
+		deadline = since.Add(timeout)
+	}
+
+	for {
+		svc, err := describeService(cluster, service, ecsClient)
+		if err != nil {
+			return err
+		}
+
+		printServiceEvents(svc.Events, since, seen)
+
+		if serviceIsStable(svc) {
+			return nil
+		}
+
+		stopped, err := stoppedTasks(cluster, service, primaryDeployment(svc), since, ecsClient)
+		if err != nil {
+			return err
+		}
+		if len(stopped) >= maxStoppedTasks {
+			return stoppedTasksFailure(service, stopped)
+		}
+
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return errDeployTimeout
+		}
+
+		time.Sleep(time.Duration(sleepTime) * time.Second)
+	}
+}
+
+// Prints service events created since the given time that haven't been
+// printed yet. ECS returns the events newest first.
+func printServiceEvents(events []*ecs.ServiceEvent, since time.Time, seen map[string]bool) {
+	for i := len(events) - 1; i >= 0; i-- {
+		event := events[i]
+		if aws.TimeValue(event.CreatedAt).Before(since) || seen[aws.StringValue(event.Id)] {
+			continue
+		}
+		seen[aws.StringValue(event.Id)] = true
+
+		fmt.Fprintf(os.Stderr, "%s %s\n",
+			aws.TimeValue(event.CreatedAt).Local().Format("2006-01-02 15:04:05"),
+			aws.StringValue(event.Message),
+		)
+	}
+}
+
+// Returns the service's primary deployment, or nil if it doesn't have one.
+func primaryDeployment(svc *ecs.Service) *ecs.Deployment {
+	for _, deployment := range svc.Deployments {
+		if aws.StringValue(deployment.Status) == deploymentStatusPrimary {
+			return deployment
+		}
+	}
+	return nil
+}
+
+// Returns the tasks of a deployment that stopped abnormally since the given
+// time. Tasks of older deployments being drained and tasks stopped to scale
+// the service aren't failures, so they're left out.
+func stoppedTasks(cluster, service string, deployment *ecs.Deployment, since time.Time, ecsClient *ecs.ECS) ([]*ecs.Task, error) {
+	var stopped []*ecs.Task
+
+	if deployment == nil {
+		return stopped, nil
+	}
+
+	listResp, err := ecsClient.ListTasks(&ecs.ListTasksInput{
+		Cluster:       aws.String(cluster),
+		ServiceName:   aws.String(service),
+		DesiredStatus: aws.String(ecs.DesiredStatusStopped),
+		MaxResults:    aws.Int64(100),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(listResp.TaskArns) == 0 {
+		return stopped, nil
+	}
+
+	resp, err := ecsClient.DescribeTasks(&ecs.DescribeTasksInput{
+		Cluster: aws.String(cluster),
+		Tasks:   listResp.TaskArns,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, task := range resp.Tasks {
+		if task.StoppedAt == nil || aws.TimeValue(task.StoppedAt).Before(since) {
+			continue
+		}
+		if taskInDeployment(task, deployment) && taskFailed(task) {
+			stopped = append(stopped, task)
+		}
+	}
+
+	return stopped, nil
+}
+
+// Reports whether a task was started by a deployment. ECS marks the tasks a
+// service starts with the deployment's ID, older tasks are matched by their
+// task definition.
+func taskInDeployment(task *ecs.Task, deployment *ecs.Deployment) bool {
+	if aws.StringValue(task.StartedBy) == aws.StringValue(deployment.Id) {
+		return true
+	}
+	return aws.StringValue(task.TaskDefinitionArn) == aws.StringValue(deployment.TaskDefinition)
+}
+
+// Reports whether a stopped task failed rather than being stopped by ECS to
+// scale or replace it.
+func taskFailed(task *ecs.Task) bool {
+	for _, c := range task.Containers {
+		if aws.Int64Value(c.ExitCode) != 0 {
+			return true
+		}
+	}
+	return !strings.HasPrefix(aws.StringValue(task.StoppedReason), scalingStoppedReason)
+}
+
+func stoppedTasksFailure(service string, tasks []*ecs.Task) error {
+	reasons := []string{fmt.Sprintf("%d tasks of the new deployment of service %s failed", len(tasks), service)}
+
+	for _, task := range tasks {
+		reason := aws.StringValue(task.StoppedReason)
+		for _, c := range task.Containers {
+			if aws.StringValue(c.Reason) != "" {
+				reason = fmt.Sprintf("%s; %s: %s", reason, aws.StringValue(c.Name), aws.StringValue(c.Reason))
+			} else if c.ExitCode != nil && aws.Int64Value(c.ExitCode) != 0 {
+				reason = fmt.Sprintf("%s; %s exited with %d", reason, aws.StringValue(c.Name), aws.Int64Value(c.ExitCode))
+			}
+		}
+		reasons = append(reasons, fmt.Sprintf("%s: %s", aws.StringValue(task.TaskArn), reason))
+	}
+
+	return errors.New(strings.Join(reasons, "\n  "))
+}
+
+// Finds the ECS services created by a stack along with the cluster they run
+// in. The cluster comes from the environment's config, then a cluster created
+// by the same stack and finally the default cluster.
+func findStackServices(stackName string, envConfig utils.EnvConfig, cf *cloudformation.CloudFormation) (string, []string, error) {
+	var (
+		services []string
+		cluster  = envConfig.Cluster
+	)
+
+	params := &cloudformation.ListStackResourcesInput{
+		StackName: aws.String(stackName),
+	}
+
+	err := cf.ListStackResourcesPages(params, func(page *cloudformation.ListStackResourcesOutput, lastPage bool) bool {
+		for _, resource := range page.StackResourceSummaries {
+			switch aws.StringValue(resource.ResourceType) {
+			case "AWS::ECS::Service":
+				services = append(services, aws.StringValue(resource.PhysicalResourceId))
+			case "AWS::ECS::Cluster":
+				if cluster == "" {
+					cluster = aws.StringValue(resource.PhysicalResourceId)
+				}
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return "", nil, err
+	}
+
+	if cluster == "" {
+		cluster = defaultCluster
+	}
+
+	return cluster, services, nil
+}
+
+func serviceIsStable(svc *ecs.Service) bool {
+	if len(svc.Deployments) != 1 {
+		return false
+	}
+
+	deployment := svc.Deployments[0]
+	return aws.StringValue(deployment.Status) == deploymentStatusPrimary &&
+		aws.Int64Value(deployment.RunningCount) == aws.Int64Value(deployment.DesiredCount)
+}
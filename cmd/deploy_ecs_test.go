@@ -0,0 +1,133 @@
+package cmd
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+const fargateTaskDefinition = `{
+	"taskDefinitionArn": "arn:aws:ecs:us-east-1:123:task-definition/app:4",
+	"family": "app",
+	"revision": 4,
+	"status": "ACTIVE",
+	"taskRoleArn": "arn:aws:iam::123:role/app-task",
+	"executionRoleArn": "arn:aws:iam::123:role/app-execution",
+	"networkMode": "awsvpc",
+	"requiresCompatibilities": ["FARGATE"],
+	"compatibilities": ["EC2", "FARGATE"],
+	"cpu": "512",
+	"memory": "1024",
+	"pidMode": "task",
+	"ipcMode": "none",
+	"placementConstraints": [{"type": "memberOf", "expression": "attribute:ecs.os-type == linux"}],
+	"volumes": [{"name": "tmp"}],
+	"containerDefinitions": [
+		{"name": "app", "image": "123.dkr.ecr.us-east-1.amazonaws.com/app:2401020304", "essential": true},
+		{"name": "proxy", "image": "nginx:1.15", "essential": true}
+	]
+}`
+
+// Serves the ECS calls made to register a new task definition for a service
+// and returns the body of the RegisterTaskDefinition request.
+func fakeECS(t *testing.T) (*ecs.ECS, func() map[string]interface{}, func()) {
+	var registered map[string]interface{}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+
+		switch target := r.Header.Get("X-Amz-Target"); target {
+		case "AmazonEC2ContainerServiceV20141113.DescribeServices":
+			w.Write([]byte(`{"services": [{"serviceName": "app", "taskDefinition": "arn:aws:ecs:us-east-1:123:task-definition/app:4"}]}`))
+		case "AmazonEC2ContainerServiceV20141113.DescribeTaskDefinition":
+			w.Write([]byte(`{"taskDefinition": ` + fargateTaskDefinition + `, "tags": [{"key": "team", "value": "web"}]}`))
+		case "AmazonEC2ContainerServiceV20141113.RegisterTaskDefinition":
+			json.NewDecoder(r.Body).Decode(&registered)
+			w.Write([]byte(`{"taskDefinition": {"taskDefinitionArn": "arn:aws:ecs:us-east-1:123:task-definition/app:5"}}`))
+		default:
+			t.Errorf("Unexpected ECS request %s", target)
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+		}
+	}))
+
+	sess := session.New(aws.NewConfig().
+		WithRegion("us-east-1").
+		WithEndpoint(srv.URL).
+		WithCredentials(credentials.NewStaticCredentials("id", "secret", "")))
+
+	return ecs.New(sess), func() map[string]interface{} { return registered }, srv.Close
+}
+
+func TestRegisterTaskDefinitionFargate(t *testing.T) {
+	ecsClient, registered, cleanup := fakeECS(t)
+	defer cleanup()
+
+	image := "123.dkr.ecr.us-east-1.amazonaws.com/app:2401050607"
+	arn, err := registerTaskDefinition("default", "app", image, "app", ecsClient)
+	if err != nil {
+		t.Fatalf("registerTaskDefinition returned an error: %s", err)
+	}
+	if arn != "arn:aws:ecs:us-east-1:123:task-definition/app:5" {
+		t.Errorf("registerTaskDefinition = %s, want the new revision", arn)
+	}
+
+	var described map[string]interface{}
+	if err := json.Unmarshal([]byte(fargateTaskDefinition), &described); err != nil {
+		t.Fatal(err)
+	}
+
+	got := registered()
+	for _, field := range []string{"family", "taskRoleArn", "executionRoleArn", "networkMode", "requiresCompatibilities", "cpu", "memory", "pidMode", "ipcMode", "placementConstraints", "volumes"} {
+		if !reflect.DeepEqual(got[field], described[field]) {
+			t.Errorf("Registered %s = %v, want %v", field, got[field], described[field])
+		}
+	}
+
+	// Only settings ECS fills in are left out
+	for _, field := range []string{"taskDefinitionArn", "revision", "status", "compatibilities"} {
+		if _, ok := got[field]; ok {
+			t.Errorf("Registered task definition has %s set", field)
+		}
+	}
+
+	tags, _ := json.Marshal(got["tags"])
+	if string(tags) != `[{"key":"team","value":"web"}]` {
+		t.Errorf("Registered tags = %s, want the described tags", tags)
+	}
+
+	containers, _ := got["containerDefinitions"].([]interface{})
+	if len(containers) != 2 {
+		t.Fatalf("Registered %d containers, want 2", len(containers))
+	}
+	for _, c := range containers {
+		container := c.(map[string]interface{})
+		want := "nginx:1.15"
+		if container["name"] == "app" {
+			want = image
+		}
+		if container["image"] != want {
+			t.Errorf("Container %s has image %s, want %s", container["name"], container["image"], want)
+		}
+	}
+}
+
+func TestRegisterTaskDefinitionUnknownContainer(t *testing.T) {
+	ecsClient, registered, cleanup := fakeECS(t)
+	defer cleanup()
+
+	_, err := registerTaskDefinition("default", "app", "app:2401050607", "", ecsClient)
+	if err == nil || !strings.Contains(err.Error(), "multiple containers") {
+		t.Errorf("registerTaskDefinition without a container name = %v, want an error naming the containers", err)
+	}
+	if registered() != nil {
+		t.Errorf("registerTaskDefinition registered a task definition after failing")
+	}
+}
@@ -0,0 +1,180 @@
+package cmd
+
+import (
+	"build_tool/utils"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/spf13/cobra"
+)
+
+var (
+	diffContainer string
+	diffMarkdown  bool
+)
+
+func init() {
+	diffCli.Flags().StringVarP(&diffContainer, "container", "c", "", "container that would be deployed. Default: the latest build for the env")
+	diffCli.Flags().BoolVar(&diffMarkdown, "markdown", false, "print the changelog as Markdown")
+	RootCmd.AddCommand(diffCli)
+}
+
+var diffCli = &cobra.Command{
+	Use:   "diff",
+	Short: "Lists the commits a deploy would ship",
+	Long:  `Lists the git commits between the container running in an environment and the container that would be deployed, grouped by author`,
+	Run: func(cmd *cobra.Command, args []string) {
+		diff()
+	},
+}
+
+// Commits between the deployed container and a candidate container.
+type changelog struct {
+	Env      string
+	From     string
+	To       string
+	Commits  []utils.GitCommit
+	Reverted []utils.GitCommit
+}
+
+func diff() {
+	sess, err := utils.GetAWSSession(Region, Profile)
+	if err != nil {
+		utils.ErrorAndQuit("Error getting AWS Session", err, 3)
+	}
+
+	envSess, err := envAWSSession(AppEnv)
+	if err != nil {
+		utils.ErrorAndQuit("Error getting AWS Session for the environment", err, 3)
+	}
+
+	candidate, source, err := findContainer(diffContainer, Config.EcrRepo, Config.Name, AppEnv, sess)
+	if err != nil {
+		utils.ErrorAndQuit("No container provided and could not find container", err, 5)
+	}
+
+	stackName := utils.GetTaskStackName(AppEnv, Config.Stack)
+	cl, err := buildChangelog(AppEnv, stackName, changelogImage(candidate, source), envSess)
+	if err != nil {
+		utils.ErrorAndQuit("Unable to build the changelog", err, 5)
+	}
+
+	printChangelog(os.Stdout, cl, diffMarkdown)
+}
+
+// Builds the changelog between the container running in a stack and the
+// candidate container using the commit labels of both images.
+//
+// env -- Environment being deployed to
+// stackName -- Name of the stack running the deployed container
+// candidate -- Full name of the container that would be deployed
+// sess -- AWS session for the environment's account
+func buildChangelog(env, stackName, candidate string, sess *session.Session) (*changelog, error) {
+	deployed, err := deployedContainer(stackName, Config.Envs[env], sess)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to find the running container: %s", err)
+	}
+
+	from, err := imageCommit(deployed)
+	if err != nil {
+		return nil, err
+	}
+
+	to, err := imageCommit(candidate)
+	if err != nil {
+		return nil, err
+	}
+
+	cl := &changelog{Env: env, From: from, To: to}
+
+	if cl.Commits, err = utils.GitLog(from, to); err != nil {
+		return nil, err
+	}
+
+	// Deploying an older container takes commits back out
+	if cl.Reverted, err = utils.GitLog(to, from); err != nil {
+		return nil, err
+	}
+
+	return cl, nil
+}
+
+// Returns the commit an image was built from.
+func imageCommit(image string) (string, error) {
+	config, err := utils.GetRemoteImageConfig(image, Profile)
+	if err != nil {
+		return "", fmt.Errorf("Unable to read the labels of %s: %s", image, err)
+	}
+
+	commit := config.Label(utils.CommitLabel)
+	if commit == "" {
+		return "", fmt.Errorf("%s has no %s label", image, utils.CommitLabel)
+	}
+
+	return commit, nil
+}
+
+// Prints the changelog with commits grouped by author, either as plain text
+// or as Markdown for release notes and PR comments.
+func printChangelog(w io.Writer, cl *changelog, markdown bool) {
+	if markdown {
+		fmt.Fprintf(w, "## Changes to %s\n\n`%s`...`%s`\n", cl.Env, cl.From, cl.To)
+	} else {
+		fmt.Fprintf(w, "Changes to %s (%s..%s)\n", cl.Env, cl.From, cl.To)
+	}
+
+	if len(cl.Commits) == 0 && len(cl.Reverted) == 0 {
+		if markdown {
+			fmt.Fprintln(w, "\nNo changes")
+		} else {
+			fmt.Fprintln(w, "  No changes")
+		}
+		return
+	}
+
+	printCommitsByAuthor(w, "", cl.Commits, markdown)
+	printCommitsByAuthor(w, "Reverted", cl.Reverted, markdown)
+}
+
+func printCommitsByAuthor(w io.Writer, heading string, commits []utils.GitCommit, markdown bool) {
+	if len(commits) == 0 {
+		return
+	}
+
+	var authors []string
+	byAuthor := make(map[string][]utils.GitCommit)
+	for _, commit := range commits {
+		if _, ok := byAuthor[commit.Author]; !ok {
+			authors = append(authors, commit.Author)
+		}
+		byAuthor[commit.Author] = append(byAuthor[commit.Author], commit)
+	}
+	sort.Strings(authors)
+
+	if heading != "" {
+		if markdown {
+			fmt.Fprintf(w, "\n### %s\n", heading)
+		} else {
+			fmt.Fprintf(w, "\n%s:\n", heading)
+		}
+	}
+
+	for _, author := range authors {
+		if markdown {
+			fmt.Fprintf(w, "\n**%s**\n\n", author)
+		} else {
+			fmt.Fprintf(w, "\n  %s\n", author)
+		}
+
+		for _, commit := range byAuthor[author] {
+			if markdown {
+				fmt.Fprintf(w, "- `%s` %s\n", commit.SHA, commit.Subject)
+			} else {
+				fmt.Fprintf(w, "    %s %s\n", commit.SHA, commit.Subject)
+			}
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package cmd
+
+import (
+	"build_tool/utils"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+// Builds the health checks for an environment. URLs taken from a stack output
+// are looked up from the stack's current outputs.
+func resolveHealthChecks(stackName string, configs []utils.HealthCheckConfig, cf *cloudformation.CloudFormation) ([]utils.HealthCheck, error) {
+	var (
+		checks  []utils.HealthCheck
+		outputs map[string]string
+	)
+
+	for _, config := range configs {
+		url := config.URL
+		if url == "" && config.Output == "" {
+			return nil, fmt.Errorf("Health checks need either a url or an output")
+		}
+
+		if url == "" {
+			if outputs == nil {
+				var err error
+				if outputs, err = stackOutputs(stackName, cf); err != nil {
+					return nil, err
+				}
+			}
+
+			base, ok := outputs[config.Output]
+			if !ok {
+				return nil, fmt.Errorf("Stack %s has no output %s", stackName, config.Output)
+			}
+			url = strings.TrimRight(base, "/") + config.Path
+		}
+
+		check, err := utils.NewHealthCheck(url, config)
+		if err != nil {
+			return nil, err
+		}
+		checks = append(checks, check)
+	}
+
+	return checks, nil
+}
+
+// Returns a stack's outputs keyed by their names.
+func stackOutputs(stackName string, cf *cloudformation.CloudFormation) (map[string]string, error) {
+	resp, err := cf.DescribeStacks(&cloudformation.DescribeStacksInput{
+		StackName: aws.String(stackName),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Stacks) == 0 {
+		return nil, fmt.Errorf("Stack %s not found", stackName)
+	}
+
+	outputs := make(map[string]string)
+	for _, output := range resp.Stacks[0].Outputs {
+		outputs[aws.StringValue(output.OutputKey)] = aws.StringValue(output.OutputValue)
+	}
+
+	return outputs, nil
+}
+
+// Runs the environment's health checks, returning the first failure.
+func runHealthChecks(stackName string, envConfig utils.EnvConfig, sess *session.Session) error {
+	checks, err := resolveHealthChecks(stackName, envConfig.HealthChecks, cloudformation.New(sess))
+	if err != nil {
+		return err
+	}
+
+	for _, check := range checks {
+		fmt.Fprintf(os.Stderr, "Checking %s\n", check.URL)
+		if err := check.Run(nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Returns the full name of the container currently deployed to an
+// environment, in whichever registry the environment pulls it from.
+func deployedContainer(stackName string, envConfig utils.EnvConfig, sess *session.Session) (string, error) {
+	if envConfig.DeployMode != utils.DeployModeECS {
+		return utils.FindLatestDeployImage(stackName, sess)
+	}
+
+	// Services deployed without Cloudformation have moved on from the task
+	// definition in the stack, so the service itself is asked.
+	cluster := envConfig.Cluster
+	if cluster == "" {
+		cluster = defaultCluster
+	}
+
+	service := envConfig.Service
+	if service == "" {
+		service = stackName
+	}
+
+	ecsClient := ecs.New(sess)
+	svc, err := describeService(cluster, service, ecsClient)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := ecsClient.DescribeTaskDefinition(&ecs.DescribeTaskDefinitionInput{
+		TaskDefinition: svc.TaskDefinition,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	definition, err := findContainerDefinition(resp.TaskDefinition.ContainerDefinitions, envConfig.ContainerName)
+	if err != nil {
+		return "", err
+	}
+
+	return aws.StringValue(definition.Image), nil
+}
@@ -0,0 +1,152 @@
+package cmd
+
+import (
+	"build_tool/utils"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/spf13/cobra"
+)
+
+var breakLockYes bool
+
+func init() {
+	lockBreakCli.Flags().BoolVarP(&breakLockYes, "yes", "y", false, "break the lock without asking for confirmation")
+	lockCli.AddCommand(lockStatusCli)
+	lockCli.AddCommand(lockBreakCli)
+	RootCmd.AddCommand(lockCli)
+}
+
+var lockCli = &cobra.Command{
+	Use:   "lock",
+	Short: "Manages the deploy lock for an environment",
+	Long:  `Manages the lock deploys take so only one deploy runs against an environment's stack at a time`,
+}
+
+var lockStatusCli = &cobra.Command{
+	Use:   "status",
+	Short: "Shows who holds the deploy lock for an environment",
+	Long:  `Shows who holds the deploy lock for an environment`,
+	Run: func(cmd *cobra.Command, args []string) {
+		lockStatus()
+	},
+}
+
+var lockBreakCli = &cobra.Command{
+	Use:   "break",
+	Short: "Removes the deploy lock for an environment",
+	Long:  `Removes the deploy lock for an environment no matter who holds it. Use this when a deploy died without releasing its lock`,
+	Run: func(cmd *cobra.Command, args []string) {
+		breakLock()
+	},
+}
+
+func deployLocker() (utils.Locker, string) {
+	envSess, err := envAWSSession(AppEnv)
+	if err != nil {
+		utils.ErrorAndQuit("Error getting AWS Session for the environment", err, 3)
+	}
+
+	locker, err := utils.NewLocker(Config.Lock, envSess)
+	if err != nil {
+		utils.ErrorAndQuit("Unable to setup deploy locks", err, 3)
+	}
+
+	return locker, utils.GetTaskStackName(AppEnv, Config.Stack)
+}
+
+func lockStatus() {
+	locker, name := deployLocker()
+
+	lock, err := locker.Get(name)
+	if err != nil {
+		utils.ErrorAndQuit("Unable to look up the deploy lock", err, 5)
+	}
+
+	if lock == nil {
+		fmt.Printf("%s is not locked\n", name)
+		return
+	}
+
+	state := "held"
+	if lock.Expired() {
+		state = "expired"
+	}
+
+	fmt.Printf("Lock:     %s (%s)\n", name, state)
+	fmt.Printf("Owner:    %s\n", lock.Owner)
+	fmt.Printf("Info:     %s\n", lock.Info)
+	fmt.Printf("Acquired: %s\n", lock.AcquiredAt.Local().Format(time.RFC3339))
+	fmt.Printf("Expires:  %s\n", lock.ExpiresAt.Local().Format(time.RFC3339))
+}
+
+func breakLock() {
+	locker, name := deployLocker()
+
+	lock, err := locker.Get(name)
+	if err != nil {
+		utils.ErrorAndQuit("Unable to look up the deploy lock", err, 5)
+	}
+
+	if lock == nil {
+		fmt.Printf("%s is not locked\n", name)
+		return
+	}
+
+	if !breakLockYes && !utils.Confirm(fmt.Sprintf("Break the lock on %s held by %s?", name, lock.Owner)) {
+		return
+	}
+
+	if err := locker.Break(name); err != nil {
+		utils.ErrorAndQuit("Unable to break the deploy lock", err, 5)
+	}
+
+	fmt.Printf("Broke the lock on %s held by %s\n", name, lock.Owner)
+}
+
+// Takes the deploy lock for a stack and returns a function that releases it.
+// The lock is renewed until it's released, and is also released if the
+// program quits before the deploy finishes. An interrupt may leave a stack
+// update running, so the lock is kept then and expires after its TTL unless
+// it's broken. Quits with an error if someone else holds the lock.
+//
+// stackName -- Name of the stack being deployed, used as the lock name
+// info -- What the lock is taken for, recorded with the lock
+// sess -- AWS session for the environment's account
+func acquireDeployLock(stackName, info string, sess *session.Session) func() {
+	locker, err := utils.NewLocker(Config.Lock, sess)
+	if err != nil {
+		utils.ErrorAndQuit("Unable to setup deploy locks", err, 3)
+	}
+
+	lock := utils.NewLock(stackName, info, Config.Lock.TTL.Duration)
+
+	logger.Debugf("Taking deploy lock %s", stackName)
+	if err := locker.Acquire(lock); err != nil {
+		utils.ErrorAndQuit("Unable to take the deploy lock", err, 9)
+	}
+	stopRenewing := utils.KeepLock(locker, lock)
+
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			stopRenewing()
+
+			if utils.ExitCode() == utils.ExitCodeInterrupted {
+				fmt.Fprintf(os.Stderr, "Keeping the deploy lock on %s since the stack may still be updating. Use lock break once it has finished\n", stackName)
+				return
+			}
+
+			logger.Debugf("Releasing deploy lock %s", stackName)
+			if err := locker.Release(lock.Name, lock.Owner); err != nil {
+				fmt.Fprintf(os.Stderr, "Unable to release the deploy lock: %s\n", err)
+			}
+		})
+	}
+	utils.AtExit(release)
+
+	return release
+}
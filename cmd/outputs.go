@@ -0,0 +1,145 @@
+package cmd
+
+import (
+	"build_tool/utils"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/spf13/cobra"
+)
+
+const (
+	outputsFormatDotenv = "dotenv"
+	outputsFormatJSON   = "json"
+	outputsFormatGitHub = "github"
+
+	githubOutputEnv = "GITHUB_OUTPUT"
+)
+
+var (
+	outputsFile   string
+	outputsFormat string
+
+	plainDotenvValue = regexp.MustCompile(`^[A-Za-z0-9_./:@,+=-]*$`)
+)
+
+func init() {
+	outputsCli.Flags().StringVarP(&outputsFile, "file", "o", "", "file to write the outputs to. Default: STDOUT, or $GITHUB_OUTPUT for the github format")
+	outputsCli.Flags().StringVarP(&outputsFormat, "format", "f", outputsFormatDotenv, "output format, one of dotenv, json or github")
+	RootCmd.AddCommand(outputsCli)
+}
+
+var outputsCli = &cobra.Command{
+	Use:   "outputs",
+	Short: "Prints the outputs of an environment's stack",
+	Long:  `Prints the outputs of an environment's stack as dotenv, JSON or GitHub Actions outputs for later pipeline steps`,
+	Run: func(cmd *cobra.Command, args []string) {
+		printOutputs()
+	},
+}
+
+func printOutputs() {
+	envSess, err := envAWSSession(AppEnv)
+	if err != nil {
+		utils.ErrorAndQuit("Error getting AWS Session for the environment", err, 3)
+	}
+
+	stackName := utils.GetTaskStackName(AppEnv, Config.Stack)
+	if err := exportOutputs(stackName, outputsFile, outputsFormat, cloudformation.New(envSess)); err != nil {
+		utils.ErrorAndQuit("Unable to write the stack's outputs", err, 5)
+	}
+}
+
+// Looks up a stack's outputs and writes them to a file in the given format.
+// An empty file name writes to STDOUT, except for the github format which is
+// appended to the file named by $GITHUB_OUTPUT.
+func exportOutputs(stackName, file, format string, cf *cloudformation.CloudFormation) error {
+	if !validOutputsFormat(format) {
+		return fmt.Errorf("Unknown output format %s", format)
+	}
+
+	outputs, err := stackOutputs(stackName, cf)
+	if err != nil {
+		return err
+	}
+
+	if file == "" && format == outputsFormatGitHub {
+		file = os.Getenv(githubOutputEnv)
+	}
+
+	if file == "" {
+		return writeOutputs(os.Stdout, outputs, format)
+	}
+
+	// GitHub Actions expects steps to add to the outputs file
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if format == outputsFormatGitHub {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+
+	f, err := os.OpenFile(file, flags, 0644)
+	if err != nil {
+		return err
+	}
+
+	if err := writeOutputs(f, outputs, format); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+func validOutputsFormat(format string) bool {
+	return format == outputsFormatDotenv || format == outputsFormatJSON || format == outputsFormatGitHub
+}
+
+func writeOutputs(w io.Writer, outputs map[string]string, format string) error {
+	if format == outputsFormatJSON {
+		data, err := json.MarshalIndent(outputs, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(data))
+		return err
+	}
+
+	keys := make([]string, 0, len(outputs))
+	for key := range outputs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		var err error
+		value := outputs[key]
+
+		switch {
+		case format == outputsFormatGitHub && strings.Contains(value, "\n"):
+			delimiter := fmt.Sprintf("EOF_%s", key)
+			for strings.Contains(value, delimiter) {
+				delimiter += "_"
+			}
+			_, err = fmt.Fprintf(w, "%s<<%s\n%s\n%s\n", key, delimiter, value, delimiter)
+		case format == outputsFormatGitHub:
+			_, err = fmt.Fprintf(w, "%s=%s\n", key, value)
+		case plainDotenvValue.MatchString(value):
+			_, err = fmt.Fprintf(w, "%s=%s\n", key, value)
+		default:
+			_, err = fmt.Fprintf(w, "%s=%s\n", key, strconv.Quote(value))
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
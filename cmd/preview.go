@@ -0,0 +1,390 @@
+package cmd
+
+import (
+	"build_tool/utils"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/spf13/cobra"
+)
+
+const (
+	defaultPreviewBaseEnv = "stage"
+	previewTagKey         = "build-tool:preview"
+	maxPreviewEnvLength   = 40
+)
+
+var (
+	previewBranch string
+	previewYes    bool
+
+	previewEnvInvalidChars = regexp.MustCompile(`[^a-z0-9]+`)
+)
+
+func init() {
+	previewCli.PersistentFlags().StringVarP(&previewBranch, "branch", "b", "", "branch the preview is for. Default: the checked out branch")
+	previewUpCli.Flags().StringVar(&dockerBuildArgs, "docker-args", "", "Extra arguments to be passed to a docker build")
+	previewDownCli.Flags().BoolVarP(&previewYes, "yes", "y", false, "tear down the preview without asking for confirmation")
+	previewCli.AddCommand(previewUpCli)
+	previewCli.AddCommand(previewDownCli)
+	previewCli.AddCommand(previewListCli)
+	RootCmd.AddCommand(previewCli)
+}
+
+var previewCli = &cobra.Command{
+	Use:   "preview",
+	Short: "Manages per-branch preview environments",
+	Long:  `Manages preview environments that run a branch in its own stack alongside the base environment`,
+	// The environment comes from the branch so one isn't required
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		CmdSetup()
+	},
+}
+
+var previewUpCli = &cobra.Command{
+	Use:   "up",
+	Short: "Builds the branch and deploys it to its preview stack",
+	Long:  `Builds and pushes a container for the branch and creates or updates the branch's preview stack to run it`,
+	Run: func(cmd *cobra.Command, args []string) {
+		previewUp()
+	},
+}
+
+var previewDownCli = &cobra.Command{
+	Use:   "down",
+	Short: "Deletes the branch's preview stack and images",
+	Long:  `Deletes the branch's preview stack and removes the branch's images from ECR`,
+	Run: func(cmd *cobra.Command, args []string) {
+		previewDown()
+	},
+}
+
+var previewListCli = &cobra.Command{
+	Use:   "list",
+	Short: "Lists the live preview stacks",
+	Long:  `Lists the live preview stacks along with their age so stale ones can be torn down`,
+	Run: func(cmd *cobra.Command, args []string) {
+		previewList()
+	},
+}
+
+// Turns a branch name into an environment name that is safe to use in stack
+// names and image tags.
+func previewEnvName(branch string) (string, error) {
+	env := previewEnvInvalidChars.ReplaceAllString(strings.ToLower(branch), "-")
+	if len(env) > maxPreviewEnvLength {
+		env = env[:maxPreviewEnvLength]
+	}
+	env = strings.Trim(env, "-")
+
+	if env == "" {
+		return "", fmt.Errorf("Branch %s can't be used as an environment name", branch)
+	}
+
+	return env, nil
+}
+
+func previewBaseEnv() string {
+	if Config.Preview.BaseEnv != "" {
+		return Config.Preview.BaseEnv
+	}
+	return defaultPreviewBaseEnv
+}
+
+// Works out the preview environment for the branch and makes it the current
+// environment. The preview uses the base environment's settings, with its own
+// parameters, a tag marking its stack as a preview and only the health checks
+// that follow the stack's outputs.
+func setupPreviewEnv() string {
+	branch := previewBranch
+	if branch == "" {
+		// CI systems often check out a detached HEAD but know the branch
+		branch = utils.DetectCI().Branch
+	}
+	if branch == "" {
+		var err error
+		if branch, err = utils.GitBranch(); err != nil {
+			utils.ErrorAndQuit("Unable to find the branch, use --branch to set it", err, 2)
+		}
+	}
+
+	env, err := previewEnvName(branch)
+	if err != nil {
+		utils.ErrorAndQuit("", err, 2)
+	}
+
+	if _, ok := Config.Envs[env]; ok {
+		utils.ErrorAndQuit(fmt.Sprintf("Branch %s would replace the %s environment", branch, env), nil, 2)
+	} else if _, ok := Config.CFParameters[env]; ok {
+		utils.ErrorAndQuit(fmt.Sprintf("Branch %s would replace the %s environment", branch, env), nil, 2)
+	}
+
+	envConfig := Config.Envs[previewBaseEnv()]
+	envConfig.StackTags = map[string]string{previewTagKey: branch}
+	for key, value := range Config.Envs[previewBaseEnv()].StackTags {
+		envConfig.StackTags[key] = value
+	}
+	envConfig.TerminationProtection = aws.Bool(false)
+	envConfig.HealthChecks = previewHealthChecks(envConfig.HealthChecks)
+
+	if Config.Envs == nil {
+		Config.Envs = make(map[string]utils.EnvConfig)
+	}
+	if Config.CFParameters == nil {
+		Config.CFParameters = make(map[string][]string)
+	}
+	Config.Envs[env] = envConfig
+	Config.CFParameters[env] = Config.Preview.Parameters
+
+	AppEnv = env
+	logger = logger.WithField("app_env", AppEnv)
+
+	return branch
+}
+
+// Returns the health checks that apply to a preview. Checks with a fixed URL
+// point at the base environment, so only checks that read their URL from the
+// stack's outputs are kept.
+func previewHealthChecks(checks []utils.HealthCheckConfig) []utils.HealthCheckConfig {
+	var kept []utils.HealthCheckConfig
+	for _, check := range checks {
+		if check.Output == "" {
+			logger.Debugf("Skipping the health check for %s in the preview", check.URL)
+			continue
+		}
+		kept = append(kept, check)
+	}
+	return kept
+}
+
+func previewUp() {
+	branch := setupPreviewEnv()
+	stackName := utils.GetTaskStackName(AppEnv, Config.Stack)
+
+	tag, err := nextImageTag(utils.TagKindPreview, AppEnv, time.Now())
+	if err != nil {
+		utils.ErrorAndQuit("Unable to create the preview's tag", err, 5)
+	}
+	container := fmt.Sprintf("%s/%s:%s", Config.EcrRepo, Config.Name, tag)
+
+	envSess, err := envAWSSession(AppEnv)
+	if err != nil {
+		utils.ErrorAndQuit("Error getting AWS Session for the environment", err, 3)
+	}
+
+	repoToplevel, err := utils.GitToplevel()
+	if err != nil {
+		utils.ErrorAndQuit("Error looking up top level of directory", err, 2)
+	}
+
+	dockerfile, err := findDockerfile(repoToplevel)
+	if err != nil {
+		utils.ErrorAndQuit("", err, 2)
+	}
+
+	labels, err := buildLabels()
+	if err != nil {
+		utils.ErrorAndQuit("Error looking up the git SHA", err, 2)
+	}
+
+	fmt.Fprintf(os.Stderr, "Building %s for %s\n", container, branch)
+	if err := buildContainer(container, dockerfile, dockerBuildArgs, labels); err != nil {
+		utils.ErrorAndQuit("Unable to build service container", err, 4)
+	}
+
+	if err := utils.EcrLogin(Region, Profile, Config.EcrRepo); err != nil {
+		utils.ErrorAndQuit("Unable to login to ECR", err, 2)
+	}
+
+	if _, err := utils.Push(container); err != nil {
+		utils.ErrorAndQuit("", err, 4)
+	}
+
+	if err := deployContainer(stackName, container, envSess); err == errNoChanges {
+		logger.Info("Nothing to update")
+	}
+
+	fmt.Printf("Preview %s is up for %s\n", stackName, branch)
+}
+
+func previewDown() {
+	branch := setupPreviewEnv()
+	stackName := utils.GetTaskStackName(AppEnv, Config.Stack)
+
+	if !previewYes && !utils.Confirm(fmt.Sprintf("Delete preview %s for %s?", stackName, branch)) {
+		return
+	}
+
+	sess, err := utils.GetAWSSession(Region, Profile)
+	if err != nil {
+		utils.ErrorAndQuit("Error getting AWS Session", err, 3)
+	}
+
+	envSess, err := envAWSSession(AppEnv)
+	if err != nil {
+		utils.ErrorAndQuit("Error getting AWS Session for the environment", err, 3)
+	}
+
+	release := acquireDeployLock(stackName, "tearing down the preview", envSess)
+	defer release()
+
+	cf := cloudformation.New(envSess)
+	stack, err := describePreviewStack(stackName, cf)
+	if err != nil {
+		utils.ErrorAndQuit("Unable to look up the preview stack", err, 5)
+	}
+
+	if stack != nil {
+		if _, ok := stackTags(stack)[previewTagKey]; !ok {
+			utils.ErrorAndQuit(fmt.Sprintf("%s is not a preview stack", stackName), nil, 5)
+		}
+
+		fmt.Fprintf(os.Stderr, "Deleting stack %s\n", stackName)
+		if _, err := cf.DeleteStack(&cloudformation.DeleteStackInput{StackName: stack.StackId}); err != nil {
+			utils.ErrorAndQuit("Unable to delete the preview stack", err, 6)
+		}
+
+		if err := waitForStackDelete(aws.StringValue(stack.StackId), defaultSleepTime, cf); err != nil {
+			utils.ErrorAndQuit("Preview stack was not deleted", err, 7)
+		}
+	}
+
+	logger.Debug("Looking up the preview's images")
+	images, err := utils.ListImageIds(Config.EcrRepo, Config.Name, sess)
+	if err != nil {
+		utils.ErrorAndQuit("Could not list the container's images", err, 5)
+	}
+
+	tags := previewImageTags(images, AppEnv)
+	if err := utils.DeleteImageTags(Config.EcrRepo, Config.Name, tags, sess); err != nil {
+		utils.ErrorAndQuit("Unable to remove the preview's images", err, 6)
+	}
+
+	fmt.Printf("Preview %s for %s is down, removed %d images\n", stackName, branch, len(tags))
+}
+
+// Returns the tags of a preview environment's images.
+func previewImageTags(images []*ecr.ImageIdentifier, env string) []string {
+	var tags []string
+	for _, image := range images {
+		tag := aws.StringValue(image.ImageTag)
+		if t, err := utils.ParseTag(tag); err == nil && t.Kind == utils.TagKindPreview && t.Env == env {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// Returns a stack, or nil if it doesn't exist.
+func describePreviewStack(stackName string, cf *cloudformation.CloudFormation) (*cloudformation.Stack, error) {
+	resp, err := cf.DescribeStacks(&cloudformation.DescribeStacksInput{
+		StackName: aws.String(stackName),
+	})
+	if err != nil && strings.Contains(err.Error(), "does not exist") {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if len(resp.Stacks) == 0 {
+		return nil, nil
+	}
+	return resp.Stacks[0], nil
+}
+
+func stackTags(stack *cloudformation.Stack) map[string]string {
+	tags := make(map[string]string)
+	for _, tag := range stack.Tags {
+		tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+	return tags
+}
+
+// Waits for a stack to be deleted. The stack must be given by ID since
+// deleted stacks can't be looked up by name.
+func waitForStackDelete(stackId string, sleepTime int, cf *cloudformation.CloudFormation) error {
+	for {
+		resp, err := cf.DescribeStacks(&cloudformation.DescribeStacksInput{
+			StackName: aws.String(stackId),
+		})
+		if err != nil {
+			return err
+		}
+		if len(resp.Stacks) == 0 {
+			return nil
+		}
+
+		stack := resp.Stacks[0]
+		switch aws.StringValue(stack.StackStatus) {
+		case cloudformation.StackStatusDeleteComplete:
+			return nil
+		case cloudformation.StackStatusDeleteFailed:
+			return fmt.Errorf("Stack deletion failed: %s", aws.StringValue(stack.StackStatusReason))
+		}
+
+		time.Sleep(time.Duration(sleepTime) * time.Second)
+	}
+}
+
+func previewList() {
+	envSess, err := envAWSSession(previewBaseEnv())
+	if err != nil {
+		utils.ErrorAndQuit("Error getting AWS Session for the environment", err, 3)
+	}
+
+	var previews []*cloudformation.Stack
+	cf := cloudformation.New(envSess)
+	params := &cloudformation.DescribeStacksInput{}
+	for {
+		resp, err := cf.DescribeStacks(params)
+		if err != nil {
+			utils.ErrorAndQuit("Unable to list stacks", err, 5)
+		}
+
+		for _, stack := range resp.Stacks {
+			_, ok := stackTags(stack)[previewTagKey]
+			if ok && strings.HasSuffix(aws.StringValue(stack.StackName), "-"+Config.Stack) {
+				previews = append(previews, stack)
+			}
+		}
+
+		if resp.NextToken == nil {
+			break
+		}
+		params.NextToken = resp.NextToken
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "STACK\tBRANCH\tSTATUS\tCREATED\tAGE")
+
+	for _, stack := range previews {
+		created := aws.TimeValue(stack.CreationTime)
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+			aws.StringValue(stack.StackName),
+			stackTags(stack)[previewTagKey],
+			aws.StringValue(stack.StackStatus),
+			created.Local().Format(time.RFC3339),
+			previewAge(time.Since(created)),
+		)
+	}
+
+	w.Flush()
+}
+
+// Formats the age of a preview in days and hours.
+func previewAge(age time.Duration) string {
+	days := int(age.Hours()) / 24
+	hours := int(age.Hours()) % 24
+
+	if days > 0 {
+		return fmt.Sprintf("%dd%dh", days, hours)
+	}
+	return fmt.Sprintf("%dh%dm", hours, int(age.Minutes())%60)
+}
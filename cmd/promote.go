@@ -0,0 +1,94 @@
+package cmd
+
+import (
+	"build_tool/utils"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	promoteDryRun   bool
+	promoteSkipSoak bool
+)
+
+func init() {
+	promoteCli.Flags().BoolVar(&promoteDryRun, "dry-run", false, "print the container that would be promoted without deploying it")
+	promoteCli.Flags().BoolVar(&promoteSkipSoak, "skip-soak", false, "promote the latest container even if it hasn't soaked for long enough")
+	RootCmd.AddCommand(promoteCli)
+}
+
+var promoteCli = &cobra.Command{
+	Use:   "promote",
+	Short: "Deploys the next container in the promotion chain to an environment",
+	Long:  `Finds the latest container the [promotion] config allows for an environment, such as the latest stage-pass image for prod, and deploys it`,
+	Run: func(cmd *cobra.Command, args []string) {
+		promote()
+	},
+}
+
+func promote() {
+	rule, err := Config.PromotionRule(AppEnv)
+	if err != nil {
+		utils.ErrorAndQuit("Invalid promotion config", err, 2)
+	}
+
+	if promoteSkipSoak {
+		rule.Soak = 0
+	}
+
+	sess, err := utils.GetAWSSession(Region, Profile)
+	if err != nil {
+		utils.ErrorAndQuit("Error getting AWS Session", err, 3)
+	}
+
+	logger.Debugf("Looking up the latest %s image", rule.Source())
+	tag, err := utils.FindPromotionCandidate(Config.EcrRepo, Config.Name, rule, sess)
+	if err != nil {
+		utils.ErrorAndQuit("Nothing to promote", err, 5)
+	}
+
+	fmt.Fprintf(os.Stderr, "Promoting %s from %s to %s\n", tag, rule.Source(), AppEnv)
+
+	if promoteDryRun {
+		fmt.Println(promotionImage(rule, tag))
+		return
+	}
+
+	container = promotionImage(rule, tag)
+	if source := promotionSource(rule, tag); source != "" {
+		if err := copyPromotedImage(source, container); err != nil {
+			utils.ErrorAndQuit("Unable to copy the container to the environment's registry", err, 4)
+		}
+	}
+
+	deploy()
+}
+
+// Returns the name an environment deploys a promoted tag under, which is in
+// the environment's own registry when it has one.
+func promotionImage(rule utils.PromotionRule, tag string) string {
+	registry := Config.EcrRepo
+	if rule.Registry != "" {
+		registry = rule.Registry
+	}
+	return fmt.Sprintf("%s/%s:%s", registry, Config.Name, tag)
+}
+
+// Returns the image a promoted tag is copied from when the environment has its
+// own registry, or an empty string when it deploys straight from EcrRepo.
+func promotionSource(rule utils.PromotionRule, tag string) string {
+	if rule.Registry == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s/%s:%s", Config.EcrRepo, Config.Name, tag)
+}
+
+// Copies a promoted image to the current environment's registry, using the
+// environment's credentials for the destination.
+func copyPromotedImage(source, image string) error {
+	fmt.Fprintf(os.Stderr, "Copying %s to %s\n", source, image)
+	_, err := copyImageBetweenEnvs(source, image, "", AppEnv)
+	return err
+}
@@ -47,8 +47,21 @@ func pushContainer() {
 		containerName = fmt.Sprintf("%s/%s:%s", Config.EcrRepo, Config.Name, tag)
 	}
 
+	// Tags the tag command just added in ECR are never local, so there is
+	// nothing to push for them
+	if !utils.LocalImageExists(containerName) && utils.RetaggedInEcr(containerName) {
+		found, err := utils.RemoteImageExists(containerName, Profile)
+		if err != nil {
+			utils.ErrorAndQuit(fmt.Sprintf("Unable to check for %s in the registry", containerName), err, 4)
+		}
+		if found {
+			logger.Infof("%s was tagged in the registry, nothing to push", containerName)
+			return
+		}
+	}
+
 	logger.Debugf("Pushing %s\n", containerName)
-	if err = utils.Push(containerName); err != nil {
+	if _, err = utils.Push(containerName); err != nil {
 		utils.ErrorAndQuit("", err, 4)
 	}
 }
@@ -0,0 +1,183 @@
+package cmd
+
+import (
+	"build_tool/utils"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/spf13/cobra"
+)
+
+var rollbackTo string
+
+func init() {
+	rollbackCli.Flags().StringVar(&rollbackTo, "to", "", "deploy tag to roll back to. Default: the deploy before the running container")
+	RootCmd.AddCommand(rollbackCli)
+}
+
+var rollbackCli = &cobra.Command{
+	Use:   "rollback",
+	Short: "Redeploys the previously deployed container for an environment",
+	Long:  `Redeploys the previously deployed container for an environment`,
+	Run: func(cmd *cobra.Command, args []string) {
+		rollback()
+	},
+}
+
+func rollback() {
+	envSess, err := envAWSSession(AppEnv)
+	if err != nil {
+		utils.ErrorAndQuit("Error getting AWS Session for the environment", err, 3)
+	}
+
+	stackName := utils.GetTaskStackName(AppEnv, Config.Stack)
+
+	logger.Debug("Looking up the running container")
+	current, err := deployedContainer(stackName, Config.Envs[AppEnv], envSess)
+	if err != nil {
+		utils.ErrorAndQuit("Could not look up the running container", err, 5)
+	}
+	_, currentTag := utils.SplitImageName(current)
+
+	// Environments with their own registry roll back to images in it
+	registry := imageRegistry(current)
+	sess, err := registrySession(registry)
+	if err != nil {
+		utils.ErrorAndQuit("Error getting AWS Session", err, 3)
+	}
+
+	if rollbackTo == "" {
+		logger.Debug("Looking up previous deploys")
+		images, err := utils.ListImageIds(registry, Config.Name, sess)
+		if err != nil {
+			utils.ErrorAndQuit("Could not list the container's images", err, 5)
+		}
+
+		deploys, err := utils.FindDeployTags(registry, Config.Name, AppEnv, sess)
+		if err != nil {
+			utils.ErrorAndQuit("Could not look up previous deploys", err, 5)
+		}
+
+		rollbackTo, err = previousDeployTag(deploys, imageDigest(images, currentTag))
+		if err != nil {
+			utils.ErrorAndQuit("Could not find a deploy to roll back to", err, 5)
+		}
+	}
+
+	image := fmt.Sprintf("%s/%s:%s", registry, Config.Name, rollbackTo)
+	fmt.Printf("Rolling back %s from %s to %s\n", stackName, currentTag, rollbackTo)
+
+	if err := deployContainer(stackName, image, envSess); err == errNoChanges {
+		logger.Info("Nothing to update")
+	}
+
+	logger.Debug("Recording the rollback as a deploy")
+	if err := recordDeploy(image, AppEnv); err != nil {
+		utils.ErrorAndQuit("Rollback succeeded but could not be tagged as a deploy", err, 4)
+	}
+}
+
+// Returns the registry an image is in. Images outside EcrRepo are in the
+// registry of an environment that has its own.
+func imageRegistry(image string) string {
+	repo, _ := utils.SplitImageName(image)
+	return strings.TrimSuffix(repo, "/"+Config.Name)
+}
+
+// Returns an AWS session that can read and tag images in a registry. The
+// current environment's credentials are used for any registry other than
+// EcrRepo.
+func registrySession(registry string) (*session.Session, error) {
+	if registry == Config.EcrRepo {
+		return utils.GetAWSSession(Region, Profile)
+	}
+	return envAWSSession(AppEnv)
+}
+
+// Returns the digest of the image with the given tag.
+func imageDigest(images []*ecr.ImageIdentifier, tag string) string {
+	for _, image := range images {
+		if aws.StringValue(image.ImageTag) == tag {
+			return aws.StringValue(image.ImageDigest)
+		}
+	}
+
+	return ""
+}
+
+// Finds the deploy tag that was deployed before the running image. Deploys
+// must be ordered from oldest to newest. Deploys of the running image are
+// skipped so that redeploying the same image doesn't count as a previous
+// deploy. The running image must have been deployed before, otherwise there's
+// no telling which deploy came before it.
+func previousDeployTag(deploys []*ecr.ImageIdentifier, currentDigest string) (string, error) {
+	if currentDigest == "" {
+		return "", fmt.Errorf("The running image wasn't found in the registry, use --to to pick a deploy")
+	}
+
+	// Skip any deploys made after the last time the running image was deployed
+	i := len(deploys) - 1
+	for ; i >= 0; i-- {
+		if aws.StringValue(deploys[i].ImageDigest) == currentDigest {
+			break
+		}
+	}
+	if i < 0 {
+		return "", fmt.Errorf("The running image has no deploy tag, use --to to pick a deploy")
+	}
+
+	for ; i >= 0; i-- {
+		if aws.StringValue(deploys[i].ImageDigest) != currentDigest {
+			return aws.StringValue(deploys[i].ImageTag), nil
+		}
+	}
+
+	return "", fmt.Errorf("No earlier deploy found")
+}
+
+// Tags an image as deployed to the environment and publishes the new tag. The
+// deploy tag is added in the registry the image is in.
+func recordDeploy(image, env string) error {
+	registry := imageRegistry(image)
+	if registry != Config.EcrRepo {
+		return recordRegistryDeploy(image, registry, env)
+	}
+
+	tag, err := nextImageTag(utils.TagKindDeploy, env, time.Now())
+	if err != nil {
+		return err
+	}
+
+	deployImage := fmt.Sprintf("%s/%s:%s", Config.EcrRepo, Config.Name, tag)
+	if err := retagContainer(image, deployImage); err != nil {
+		return err
+	}
+
+	// Tags added in ECR are already published
+	if !utils.LocalImageExists(deployImage) {
+		return nil
+	}
+
+	_, err = utils.Push(deployImage)
+	return err
+}
+
+// Tags an image in an environment's own registry as deployed. Images only get
+// there by being copied, so they're always tagged in ECR.
+func recordRegistryDeploy(image, registry, env string) error {
+	sess, err := registrySession(registry)
+	if err != nil {
+		return err
+	}
+
+	tag, err := utils.NextImageTag(registry, Config.Name, utils.NewTag(utils.TagKindDeploy, env, time.Now()), sess)
+	if err != nil {
+		return fmt.Errorf("Unable to look up existing tags: %s", err)
+	}
+
+	return utils.RetagEcrImage(image, fmt.Sprintf("%s/%s:%s", registry, Config.Name, tag), sess)
+}
@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"build_tool/utils"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+)
+
+func TestImageRegistry(t *testing.T) {
+	defer func(config utils.Config) { Config = config }(Config)
+	Config = utils.Config{Name: "app", EcrRepo: "123.dkr.ecr.us-east-1.amazonaws.com"}
+
+	tests := []struct {
+		image string
+		want  string
+	}{
+		{"123.dkr.ecr.us-east-1.amazonaws.com/app:2401020304", "123.dkr.ecr.us-east-1.amazonaws.com"},
+		{"456.dkr.ecr.us-west-2.amazonaws.com/app:prod-deploy-2401020304", "456.dkr.ecr.us-west-2.amazonaws.com"},
+		{"456.dkr.ecr.us-west-2.amazonaws.com/app@sha256:abc", "456.dkr.ecr.us-west-2.amazonaws.com"},
+		{"localhost:5000/app:2401020304", "localhost:5000"},
+	}
+
+	for _, test := range tests {
+		if got := imageRegistry(test.image); got != test.want {
+			t.Errorf("imageRegistry(%s) = %s, want %s", test.image, got, test.want)
+		}
+	}
+}
+
+func deployImages(deploys ...string) []*ecr.ImageIdentifier {
+	var images []*ecr.ImageIdentifier
+	for _, deploy := range deploys {
+		parts := strings.SplitN(deploy, "=", 2)
+		images = append(images, &ecr.ImageIdentifier{ImageTag: aws.String(parts[0]), ImageDigest: aws.String(parts[1])})
+	}
+	return images
+}
+
+func TestPreviousDeployTag(t *testing.T) {
+	deploys := deployImages(
+		"prod-deploy-2401010000=sha256:a",
+		"prod-deploy-2401020000=sha256:b",
+		"prod-deploy-2401030000=sha256:b",
+		"prod-deploy-2401040000=sha256:c",
+		"prod-deploy-2401050000=sha256:d",
+	)
+
+	tests := []struct {
+		name    string
+		current string
+		want    string
+		wantErr bool
+	}{
+		{name: "newest deploy running", current: "sha256:d", want: "prod-deploy-2401040000"},
+		{name: "redeployed image is skipped", current: "sha256:c", want: "prod-deploy-2401030000"},
+		{name: "image deployed twice in a row", current: "sha256:b", want: "prod-deploy-2401010000"},
+		{name: "oldest deploy running", current: "sha256:a", wantErr: true},
+		{name: "running image not found", current: "", wantErr: true},
+		{name: "running image never deployed", current: "sha256:e", wantErr: true},
+	}
+
+	for _, test := range tests {
+		got, err := previousDeployTag(deploys, test.current)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: previousDeployTag = %s, want an error", test.name, got)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: previousDeployTag returned an error: %s", test.name, err)
+		} else if got != test.want {
+			t.Errorf("%s: previousDeployTag = %s, want %s", test.name, got, test.want)
+		}
+	}
+
+	if got, err := previousDeployTag(nil, "sha256:a"); err == nil {
+		t.Errorf("previousDeployTag without deploys = %s, want an error", got)
+	}
+}
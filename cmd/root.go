@@ -5,6 +5,7 @@ import (
 	"os"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/spf13/cobra"
 )
 
@@ -77,3 +78,9 @@ func CmdSetup() {
 	}
 
 }
+
+// Returns an AWS session for the given environment, assuming the
+// environment's role when one is configured.
+func envAWSSession(env string) (*session.Session, error) {
+	return utils.GetEnvAWSSession(Region, Profile, Config.Envs[env])
+}
@@ -0,0 +1,268 @@
+package cmd
+
+import (
+	"build_tool/utils"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+const (
+	stepBuild  = "build"
+	stepTest   = "test"
+	stepTag    = "tag"
+	stepPush   = "push"
+	stepDeploy = "deploy"
+)
+
+var (
+	resumePipeline bool
+
+	defaultPipelineSteps = []utils.PipelineStep{
+		{Run: stepBuild},
+		{Run: stepTest},
+		{Run: stepTag, Tag: string(utils.TagKindPass)},
+		{Run: stepPush},
+		{Run: stepDeploy},
+	}
+)
+
+func init() {
+	runCli.Flags().BoolVar(&resumePipeline, "resume", false, "continue from the step that failed in the last run")
+	RootCmd.AddCommand(runCli)
+}
+
+var runCli = &cobra.Command{
+	Use:   "run",
+	Short: "Runs the pipeline from the config",
+	Long:  `Runs the build, test, tag, push and deploy steps from the [pipeline] section of the config in one go, stopping at the first failure`,
+	Run: func(cmd *cobra.Command, args []string) {
+		runPipeline()
+	},
+}
+
+// Progress of a pipeline run along with what earlier steps produced for later
+// ones. It is saved after every step so a failed run can be resumed.
+type pipelineState struct {
+	Env        string    `json:"env"`
+	Commit     string    `json:"commit"`
+	StartedAt  time.Time `json:"started_at"`
+	Completed  int       `json:"completed"`
+	FailedStep string    `json:"failed_step,omitempty"`
+	LocalImage string    `json:"local_image,omitempty"`
+	Image      string    `json:"image,omitempty"`
+	Digest     string    `json:"digest,omitempty"`
+	Tags       []string  `json:"tags,omitempty"`
+	Pushed     []string  `json:"pushed,omitempty"`
+}
+
+// Returns the file the pipeline's progress is kept in. Unless the config sets
+// one it's kept outside the repository, so it's never committed or sent to
+// docker with the build context.
+func pipelineStateFile() (string, error) {
+	repoToplevel, err := utils.GitToplevel()
+	if err != nil {
+		return "", err
+	}
+
+	file := Config.Pipeline.StateFile
+	if file == "" {
+		return utils.StateFile("pipeline-" + repoToplevel)
+	}
+
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(repoToplevel, file)
+	}
+	return file, nil
+}
+
+func readPipelineState(file string) (*pipelineState, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var state pipelineState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("Unable to read %s: %s", file, err)
+	}
+
+	return &state, nil
+}
+
+func writePipelineState(file string, state *pipelineState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(file, data, 0644)
+}
+
+func runPipeline() {
+	steps := Config.Pipeline.Steps
+	if len(steps) == 0 {
+		steps = defaultPipelineSteps
+	}
+
+	for i, step := range steps {
+		if err := validatePipelineStep(step); err != nil {
+			utils.ErrorAndQuit(fmt.Sprintf("Step %d of the pipeline is not valid", i+1), err, 2)
+		}
+	}
+
+	headSHA, err := utils.GitSHA("HEAD")
+	if err != nil {
+		utils.ErrorAndQuit("Error looking up the git SHA", err, 2)
+	}
+
+	stateFile, err := pipelineStateFile()
+	if err != nil {
+		utils.ErrorAndQuit("Unable to find where to save the pipeline state", err, 2)
+	}
+	state := &pipelineState{Env: AppEnv, Commit: headSHA, StartedAt: time.Now()}
+
+	if resumePipeline {
+		state, err = readPipelineState(stateFile)
+		if os.IsNotExist(err) {
+			utils.ErrorAndQuit("There is no failed run to resume", nil, 2)
+		} else if err != nil {
+			utils.ErrorAndQuit("Unable to read the pipeline state", err, 2)
+		}
+
+		if state.Env != AppEnv || state.Commit != headSHA {
+			utils.ErrorAndQuit(fmt.Sprintf("The last run was for %s at %s, not %s at %s", state.Env, state.Commit, AppEnv, headSHA), nil, 2)
+		}
+		fmt.Fprintf(os.Stderr, "Resuming the pipeline at step %d\n", state.Completed+1)
+		state.FailedStep = ""
+	}
+
+	// Steps quit on failure, so the failed step is recorded on the way out
+	current := ""
+	utils.AtExit(func() {
+		if current == "" {
+			return
+		}
+		state.FailedStep = current
+		if err := writePipelineState(stateFile, state); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to save the pipeline state: %s\n", err)
+			return
+		}
+		fmt.Fprintf(os.Stderr, "Pipeline failed at %s, fix the problem and use run --resume to continue\n", current)
+	})
+
+	for i := state.Completed; i < len(steps); i++ {
+		step := steps[i]
+		current = fmt.Sprintf("step %d (%s)", i+1, step.Run)
+
+		fmt.Fprintf(os.Stderr, "==> Running %s\n", current)
+		runPipelineStep(step, state)
+
+		state.Completed = i + 1
+		if err := writePipelineState(stateFile, state); err != nil {
+			utils.ErrorAndQuit("Unable to save the pipeline state", err, 2)
+		}
+	}
+	current = ""
+
+	if err := os.Remove(stateFile); err != nil && !os.IsNotExist(err) {
+		logger.Debugf("Unable to remove the pipeline state: %s", err)
+	}
+
+	if state.Image != "" {
+		fmt.Println(state.Image)
+	}
+}
+
+func validatePipelineStep(step utils.PipelineStep) error {
+	switch step.Run {
+	case stepBuild, stepTest, stepPush, stepDeploy:
+		return nil
+	case stepTag:
+		switch utils.TagKind(step.Tag) {
+		case "", utils.TagKindPass, utils.TagKindFail, utils.TagKindDeploy:
+			return nil
+		}
+		return fmt.Errorf("Unknown tag %s, must be one of %s, %s or %s", step.Tag, utils.TagKindPass, utils.TagKindFail, utils.TagKindDeploy)
+	}
+
+	return fmt.Errorf("Unknown step %s, must be one of %s", step.Run, strings.Join([]string{stepBuild, stepTest, stepTag, stepPush, stepDeploy}, ", "))
+}
+
+// Runs a single step, passing along what earlier steps produced through the
+// state. Quits with an error if the step fails.
+func runPipelineStep(step utils.PipelineStep, state *pipelineState) {
+	if state.LocalImage == "" {
+		state.LocalImage = fmt.Sprintf("%s:%s", Config.Name, utils.GetDockerJobTag())
+	}
+
+	switch step.Run {
+	case stepBuild:
+		dockerBuildArgs = step.DockerArgs
+		build()
+	case stepTest:
+		secretsFile = step.SecretsFile
+		extraVolumes = step.Volumes
+		testContainer()
+	case stepTag:
+		if err := utils.EcrLogin(Region, Profile, Config.EcrRepo); err != nil {
+			utils.ErrorAndQuit("Unable to login to ECR", err, 2)
+		}
+
+		kind := utils.TagKind(step.Tag)
+		if kind == "" {
+			kind = utils.TagKindPass
+		}
+
+		tag, err := nextImageTag(kind, AppEnv, time.Now())
+		if err != nil {
+			utils.ErrorAndQuit("Unable to create the tag", err, 5)
+		}
+		image := fmt.Sprintf("%s/%s:%s", Config.EcrRepo, Config.Name, tag)
+
+		if err := utils.TagContainer(state.LocalImage, image, Region, Profile); err != nil {
+			utils.ErrorAndQuit("Failed tagging container", err, 4)
+		}
+		state.Image = image
+		state.Tags = append(state.Tags, image)
+	case stepPush:
+		if err := utils.EcrLogin(Region, Profile, Config.EcrRepo); err != nil {
+			utils.ErrorAndQuit("Unable to login to ECR", err, 2)
+		}
+
+		// Without an earlier tag step the job tag is pushed, like the push
+		// command does
+		if len(state.Tags) == 0 {
+			image := fmt.Sprintf("%s/%s:%s", Config.EcrRepo, Config.Name, utils.GetDockerJobTag())
+			if err := utils.TagContainer(state.LocalImage, image, Region, Profile); err != nil {
+				utils.ErrorAndQuit("Failed tagging container", err, 4)
+			}
+			state.Image = image
+			state.Tags = append(state.Tags, image)
+		}
+
+		for _, image := range state.Tags[len(state.Pushed):] {
+			logger.Debugf("Pushing %s", image)
+			digest, err := utils.Push(image)
+			if err != nil {
+				utils.ErrorAndQuit("", err, 4)
+			}
+			state.Digest = digest
+			state.Pushed = append(state.Pushed, image)
+		}
+	case stepDeploy:
+		container = state.Image
+		// A stack that's already up to date doesn't fail the pipeline
+		deployCurrent()
+	}
+}
@@ -0,0 +1,194 @@
+package cmd
+
+import (
+	"build_tool/utils"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/spf13/cobra"
+)
+
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+)
+
+var statusOutput string
+
+func init() {
+	statusCli.Flags().StringVarP(&statusOutput, "output", "o", outputTable, "output format, either table or json")
+	RootCmd.AddCommand(statusCli)
+}
+
+var statusCli = &cobra.Command{
+	Use:   "status",
+	Short: "Shows what is deployed in every environment",
+	Long:  `Shows the container deployed to each environment in the config along with its commit, build date and the state of its stack`,
+	// Every environment is looked at so an environment isn't required
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		CmdSetup()
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		status()
+	},
+}
+
+// What is deployed to a single environment.
+type envStatus struct {
+	Env         string     `json:"env"`
+	Stack       string     `json:"stack"`
+	StackStatus string     `json:"stack_status,omitempty"`
+	LastUpdated *time.Time `json:"last_updated,omitempty"`
+	Tag         string     `json:"tag,omitempty"`
+	Commit      string     `json:"commit,omitempty"`
+	BuildDate   string     `json:"build_date,omitempty"`
+	Error       string     `json:"error,omitempty"`
+}
+
+func status() {
+	if statusOutput != outputTable && statusOutput != outputJSON {
+		utils.ErrorAndQuit(fmt.Sprintf("Unknown output format %s", statusOutput), nil, 1)
+	}
+
+	envs := configuredEnvs(Config)
+	if len(envs) == 0 {
+		utils.ErrorAndQuit("No environments found in the config", nil, 2)
+	}
+
+	var (
+		statuses []envStatus
+		failed   bool
+	)
+	for _, env := range envs {
+		logger.Debugf("Looking up the status of %s", env)
+		s := lookupEnvStatus(env)
+		if s.Error != "" {
+			failed = true
+		}
+		statuses = append(statuses, s)
+	}
+
+	if statusOutput == outputJSON {
+		out, err := json.MarshalIndent(statuses, "", "  ")
+		if err != nil {
+			utils.ErrorAndQuit("Unable to encode the status", err, 1)
+		}
+		fmt.Println(string(out))
+	} else {
+		printStatuses(statuses)
+	}
+
+	if failed {
+		utils.Exit(5)
+	}
+}
+
+// Returns the names of the environments in the config, from both the env
+// sections and the Cloudformation parameters, in sorted order.
+func configuredEnvs(config utils.Config) []string {
+	seen := make(map[string]bool)
+	for env := range config.Envs {
+		seen[env] = true
+	}
+	for env := range config.CFParameters {
+		seen[env] = true
+	}
+
+	envs := make([]string, 0, len(seen))
+	for env := range seen {
+		envs = append(envs, env)
+	}
+	sort.Strings(envs)
+
+	return envs
+}
+
+// Looks up the stack of an environment and the container running in it. The
+// first problem found is recorded in the status instead of stopping so the
+// other environments can still be shown.
+func lookupEnvStatus(env string) envStatus {
+	stackName := utils.GetTaskStackName(env, Config.Stack)
+	s := envStatus{Env: env, Stack: stackName}
+
+	sess, err := envAWSSession(env)
+	if err != nil {
+		s.Error = fmt.Sprintf("Unable to get an AWS session: %s", err)
+		return s
+	}
+
+	resp, err := cloudformation.New(sess).DescribeStacks(&cloudformation.DescribeStacksInput{
+		StackName: aws.String(stackName),
+	})
+	if err != nil {
+		s.Error = fmt.Sprintf("Unable to describe the stack: %s", err)
+		return s
+	}
+	if len(resp.Stacks) > 0 {
+		stack := resp.Stacks[0]
+		s.StackStatus = aws.StringValue(stack.StackStatus)
+		s.LastUpdated = stack.CreationTime
+		if stack.LastUpdatedTime != nil {
+			s.LastUpdated = stack.LastUpdatedTime
+		}
+	}
+
+	image, err := deployedContainer(stackName, Config.Envs[env], sess)
+	if err != nil {
+		s.Error = fmt.Sprintf("Unable to find the running container: %s", err)
+		return s
+	}
+	_, s.Tag = utils.SplitImageName(image)
+
+	imageConfig, err := utils.GetRemoteImageConfig(image, Profile)
+	if err != nil {
+		s.Error = fmt.Sprintf("Unable to read the labels of %s: %s", image, err)
+		return s
+	}
+	s.Commit = imageConfig.Label(utils.CommitLabel)
+	s.BuildDate = imageConfig.Label(utils.BuildDateLabel)
+
+	return s
+}
+
+func printStatuses(statuses []envStatus) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ENV\tSTACK\tSTATUS\tLAST UPDATED\tTAG\tCOMMIT\tBUILD DATE")
+
+	for _, s := range statuses {
+		lastUpdated := "-"
+		if s.LastUpdated != nil {
+			lastUpdated = s.LastUpdated.Local().Format(time.RFC3339)
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			s.Env,
+			s.Stack,
+			orDash(s.StackStatus),
+			lastUpdated,
+			orDash(s.Tag),
+			orDash(s.Commit),
+			orDash(s.BuildDate),
+		)
+	}
+
+	w.Flush()
+
+	for _, s := range statuses {
+		if s.Error != "" {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", s.Env, s.Error)
+		}
+	}
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -3,6 +3,7 @@ package cmd
 import (
 	"build_tool/utils"
 	"fmt"
+	"time"
 
 	"github.com/spf13/cobra"
 )
@@ -26,9 +27,9 @@ func init() {
 	tagCli.Flags().BoolVarP(&successful, "successful", "s", false, "tag the container as successful")
 	tagCli.Flags().BoolVarP(&failure, "failure", "f", false, "tag the container as successful")
 	tagCli.Flags().BoolVarP(&deployTag, "deploy", "d", false, "tag the container as deployed")
-	tagCli.Flags().StringVarP(&date, "time", "t", "", "date and time for a the tag")
+	tagCli.Flags().StringVarP(&date, "time", "t", "", "date and time for the tag in UTC, as yymmddHHMM")
 	tagCli.Flags().BoolVarP(&findLatestDeploy, "find-latest-deploy", "", false, "look up the latest deployed container for a given env")
-	tagCli.Flags().BoolVarP(&localContainer, "local", "", false, "Use a local container name")
+	tagCli.Flags().BoolVarP(&localContainer, "local", "", false, "use a local container name and tag it with the Docker daemon")
 	tagCli.Flags().BoolVarP(&outputNewName, "output-new-name", "", false, "Print the new container name to STDOUT")
 	RootCmd.AddCommand(tagCli)
 }
@@ -47,11 +48,6 @@ func tagContainer() {
 	var oldContainer string
 	var newContainer string
 
-	if err = utils.EcrLogin(Region, Profile, Config.EcrRepo); err != nil {
-		logger.Debug("Login to ECR")
-		utils.ErrorAndQuit("", err, 2)
-	}
-
 	logger.Debug("Getting original docker container name")
 	oldContainer, err = oldContainerName(AppEnv, Region, Profile, Config.Stack, Config.Name, Config.EcrRepo)
 	if err != nil {
@@ -67,7 +63,7 @@ func tagContainer() {
 	logger.Debugf("New container: %s", newContainer)
 
 	logger.Debug("Tagging container with the new name")
-	if err := utils.TagContainer(oldContainer, newContainer, Region, Profile); err != nil {
+	if err := retagContainer(oldContainer, newContainer); err != nil {
 		utils.ErrorAndQuit("Failed tagging container", err, 4)
 	}
 
@@ -76,31 +72,99 @@ func tagContainer() {
 	}
 }
 
+// Tags a container with a new name. Containers already in ECR are tagged in
+// place without pulling them. With --local, or when the container has only
+// been built locally, the Docker daemon tags the container and a later push
+// publishes the tag.
+func retagContainer(oldContainer, newContainer string) error {
+	if !localContainer && utils.SameEcrRepository(oldContainer, newContainer) {
+		sess, err := utils.GetAWSSession(Region, Profile)
+		if err != nil {
+			return err
+		}
+
+		logger.Debug("Tagging the container in ECR")
+		err = utils.RetagEcrImage(oldContainer, newContainer, sess)
+		if err == nil || !utils.LocalImageExists(oldContainer) {
+			return err
+		}
+		logger.Debugf("Tagging the local container instead: %s", err)
+	}
+
+	logger.Debug("Login to ECR")
+	if err := utils.EcrLogin(Region, Profile, Config.EcrRepo); err != nil {
+		return err
+	}
+
+	return utils.TagContainer(oldContainer, newContainer, Region, Profile)
+}
+
 func newContainerName(env, date, ecrRepo, name string, successful, failure, deployTag bool) (string, error) {
 	if newTag == "" {
-		newTag = utils.CreateTag(env, date, successful, failure, deployTag)
+		kind := utils.TagKindBuild
+		if deployTag {
+			kind = utils.TagKindDeploy
+		} else if successful {
+			kind = utils.TagKindPass
+		} else if failure {
+			kind = utils.TagKindFail
+		}
+
+		tagTime := time.Now()
+		if date != "" {
+			var err error
+			if tagTime, err = time.ParseInLocation(utils.BuildDateFormat, date, time.UTC); err != nil {
+				return "", fmt.Errorf("Time %s is not of the form %s", date, utils.BuildDateFormat)
+			}
+		}
+
+		tag, err := nextImageTag(kind, env, tagTime)
+		if err != nil {
+			return "", err
+		}
+		newTag = tag
+	} else if !utils.ValidDockerTag(newTag) {
+		return "", fmt.Errorf("%s is not a valid docker tag", newTag)
 	}
 	logger.Debug("Building out the new container name")
 	return fmt.Sprintf("%s/%s:%s", Config.EcrRepo, Config.Name, newTag), nil
 }
 
+// Creates a tag of the given kind that sorts after the tags already in the
+// container's repository. Concurrent jobs may still create the same tag.
+func nextImageTag(kind utils.TagKind, env string, t time.Time) (string, error) {
+	sess, err := utils.GetAWSSession(Region, Profile)
+	if err != nil {
+		return "", err
+	}
+
+	tag, err := utils.NextImageTag(Config.EcrRepo, Config.Name, utils.NewTag(kind, env, t), sess)
+	if err != nil {
+		return "", fmt.Errorf("Unable to look up existing tags: %s", err)
+	}
+
+	return tag.String(), nil
+}
+
 func oldContainerName(env, region, profile, stack, name, ecrRepo string) (string, error) {
-	var (
-		err          error
-		oldContainer string
-	)
+	var oldContainer string
 
 	if oldTag == "" {
 		if findLatestDeploy {
 			logger.Debug("Looking up the latest deploy for container tag")
-			logger.Debug("Looking up task in cloudformation stack")
 			stackName := utils.GetTaskStackName(env, stack)
 
-			logger.Debug("Looking for latest container tag in the discovered stack")
-			oldTag, err = utils.FindLatestDeployTag(stackName, region, profile)
+			sess, err := envAWSSession(env)
+			if err != nil {
+				return "", err
+			}
+
+			logger.Debug("Looking for the running container of the discovered stack")
+			deployed, err := deployedContainer(stackName, Config.Envs[env], sess)
 			if err != nil {
 				return "", err
 			}
+			_, oldTag = utils.SplitImageName(deployed)
 		} else {
 			logger.Debug("Creating container tag from the local environment")
 			oldTag = utils.GetDockerJobTag()
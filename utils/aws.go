@@ -1,45 +1,49 @@
 package utils
 
 import (
-	"bytes"
+	"bufio"
+	"encoding/base64"
 	"fmt"
 	"os"
-	"os/exec"
-	"regexp"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cloudformation"
 	"github.com/aws/aws-sdk-go/service/ecr"
 	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/sts"
 )
 
 // Looks up a given stack in AWS Cloudformation and returns the tag of the container
 // currently running in the stack.
 //
 // stackName -- Name of the Cloudformation stack to look up
-// region -- AWS region to use
-// profile -- AWS profile to use
-func FindLatestDeployTag(stackName, region, profile string) (string, error) {
-	var err error
-	var sess *session.Session
-	var awsConfig *aws.Config
-	var taskId string
-	var tag string
-
-	if region != "" {
-		awsConfig = &aws.Config{Region: aws.String(region)}
-	} else {
-		awsConfig = &aws.Config{}
+// sess -- AWS session for the account the stack lives in
+func FindLatestDeployTag(stackName string, sess *session.Session) (string, error) {
+	image, err := FindLatestDeployImage(stackName, sess)
+	if err != nil {
+		return "", err
 	}
 
-	sess, err = session.NewSessionWithOptions(session.Options{
-		Config:            *awsConfig,
-		Profile:           "vmnetops",
-		SharedConfigState: session.SharedConfigEnable,
-	})
+	_, tag := SplitImageName(image)
+	return tag, nil
+}
+
+// Looks up a given stack in AWS Cloudformation and returns the full name of the
+// container currently running in the stack, including the registry it's pulled
+// from.
+//
+// stackName -- Name of the Cloudformation stack to look up
+// sess -- AWS session for the account the stack lives in
+func FindLatestDeployImage(stackName string, sess *session.Session) (string, error) {
+	var taskId string
+	var image string
 
 	cf := cloudformation.New(sess)
 	params := &cloudformation.ListStackResourcesInput{
@@ -71,21 +75,22 @@ func FindLatestDeployTag(stackName, region, profile string) (string, error) {
 
 	containerName := strings.Join(strings.Split(stackName, "-")[0:2], "-")
 	if len(ecsResp.TaskDefinition.ContainerDefinitions) == 1 {
-		tag = strings.Split(aws.StringValue(ecsResp.TaskDefinition.ContainerDefinitions[0].Image), ":")[1]
+		image = aws.StringValue(ecsResp.TaskDefinition.ContainerDefinitions[0].Image)
 	} else {
 		for _, v := range ecsResp.TaskDefinition.ContainerDefinitions {
 			if aws.StringValue(v.Name) == containerName {
-				// v.Image is of the form <repo>/<image>:<tag>
-				// repo and image cannot have a ":" in them
-				// so there are only two splits and we want the second
-				tag = strings.Split(aws.StringValue(v.Image), ":")[1]
+				image = aws.StringValue(v.Image)
 				break
 			}
 		}
 	}
-	return tag, nil
+	return image, nil
 }
 
+// Creates an AWS session using the shared config and credentials files.
+//
+// region -- AWS region to use
+// profile -- AWS profile to use. The default profile is used when empty
 func GetAWSSession(region, profile string) (*session.Session, error) {
 	var awsConfig *aws.Config
 
@@ -97,140 +102,576 @@ func GetAWSSession(region, profile string) (*session.Session, error) {
 
 	sess, err := session.NewSessionWithOptions(session.Options{
 		Config:            *awsConfig,
-		Profile:           "vmnetops",
+		Profile:           profile,
 		SharedConfigState: session.SharedConfigEnable,
 	})
 
 	return sess, err
 }
 
+// Creates an AWS session for an environment. When the environment has a role
+// configured the session uses credentials from assuming that role.
+//
+// region -- AWS region to use
+// profile -- AWS profile used to assume the role
+// env -- Settings for the environment
+func GetEnvAWSSession(region, profile string, env EnvConfig) (*session.Session, error) {
+	sess, err := GetAWSSession(region, profile)
+	if err != nil || env.RoleArn == "" {
+		return sess, err
+	}
+
+	creds := credentials.NewCredentials(&assumeRoleProvider{
+		sess:      sess,
+		env:       env,
+		cacheName: fmt.Sprintf("sts-%s-%s", profile, env.RoleArn),
+	})
+
+	return sess.Copy(&aws.Config{Credentials: creds}), nil
+}
+
+// Credentials for an assumed role along with when they expire.
+type roleCredentials struct {
+	Value      credentials.Value
+	Expiration time.Time
+}
+
+// Provides credentials by assuming a role with STS. Credentials are cached on
+// disk so separate runs of the tool don't need to assume the role again until
+// they expire.
+type assumeRoleProvider struct {
+	credentials.Expiry
+
+	sess      *session.Session
+	env       EnvConfig
+	cacheName string
+}
+
+func (p *assumeRoleProvider) Retrieve() (credentials.Value, error) {
+	var cached roleCredentials
+	if readCache(p.cacheName, &cached) && time.Now().Add(roleExpiryWindow).Before(cached.Expiration) {
+		p.SetExpiration(cached.Expiration, roleExpiryWindow)
+		return cached.Value, nil
+	}
+
+	input := &sts.AssumeRoleInput{
+		RoleArn:         aws.String(p.env.RoleArn),
+		RoleSessionName: aws.String(fmt.Sprintf("build_tool-%d", time.Now().Unix())),
+		DurationSeconds: aws.Int64(int64(roleDuration / time.Second)),
+	}
+
+	if p.env.ExternalId != "" {
+		input.ExternalId = aws.String(p.env.ExternalId)
+	}
+
+	if p.env.MfaSerial != "" {
+		code, err := readMFACode(p.env.MfaSerial)
+		if err != nil {
+			return credentials.Value{}, err
+		}
+		input.SerialNumber = aws.String(p.env.MfaSerial)
+		input.TokenCode = aws.String(code)
+	}
+
+	resp, err := sts.New(p.sess).AssumeRole(input)
+	if err != nil {
+		return credentials.Value{}, fmt.Errorf("Unable to assume role %s: %s", p.env.RoleArn, err)
+	}
+
+	cached = roleCredentials{
+		Value: credentials.Value{
+			AccessKeyID:     aws.StringValue(resp.Credentials.AccessKeyId),
+			SecretAccessKey: aws.StringValue(resp.Credentials.SecretAccessKey),
+			SessionToken:    aws.StringValue(resp.Credentials.SessionToken),
+			ProviderName:    "AssumeRoleProvider",
+		},
+		Expiration: aws.TimeValue(resp.Credentials.Expiration),
+	}
+
+	if err := writeCache(p.cacheName, cached); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to cache role credentials: %s\n", err)
+	}
+	p.SetExpiration(cached.Expiration, roleExpiryWindow)
+
+	return cached.Value, nil
+}
+
+func readMFACode(serial string) (string, error) {
+	fmt.Fprintf(os.Stderr, "Enter MFA code for %s: ", serial)
+
+	code, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return "", fmt.Errorf("Unable to read MFA code: %s", err)
+	}
+
+	return strings.TrimSpace(code), nil
+}
+
+const (
+	ecrTokenExpiryWindow = 5 * time.Minute
+	roleExpiryWindow     = 5 * time.Minute
+	roleDuration         = time.Hour
+	ecrRetagLifetime     = 24 * time.Hour
+	ecrRetagsCacheName   = "ecr-retags"
+)
+
 func getRegistryId(ecr string) string {
 	ecrParts := strings.Split(ecr, ".")
 
 	return ecrParts[0]
 }
 
-// Looks up a given stack in an AWS ECR and returns the tag of the container
-// that was most recently built.
+// Turns termination protection for a stack on or off.
 //
-// ecr -- Name of the AWS ECR to use
-// region -- AWS region to use
-// profile -- AWS profile to use
-func FindLatestBuildTag(ecrRepo, name, env string, sess *session.Session) (string, error) {
-	var (
-		nextToken string
-		tagRegExp string
-		matches   []string
-	)
+// stackName -- Name of the Cloudformation stack
+// enabled -- Whether the stack should be protected
+// cf -- Cloudformation client to use
+func SetTerminationProtection(stackName string, enabled bool, cf *cloudformation.CloudFormation) error {
+	_, err := cf.UpdateTerminationProtection(&cloudformation.UpdateTerminationProtectionInput{
+		EnableTerminationProtection: aws.Bool(enabled),
+		StackName:                   aws.String(stackName),
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to update termination protection: %s", err)
+	}
 
-	registryId := getRegistryId(ecrRepo)
+	return nil
+}
 
-	client := ecr.New(sess)
+// Lists every image in an ECR repository.
+//
+// ecrRepo -- Name of the AWS ECR to use
+// name -- Name of the repository in the ECR
+// sess -- AWS session to use
+func ListImageIds(ecrRepo, name string, sess *session.Session) ([]*ecr.ImageIdentifier, error) {
+	var imageIds []*ecr.ImageIdentifier
 
-	if env == "prod" {
-		tagRegExp = fmt.Sprintf(TagPassRegex, "stage")
-	} else {
-		tagRegExp = TagDefaultRegex
+	client := ecr.New(sess)
+	params := &ecr.ListImagesInput{
+		RepositoryName: aws.String(name),
+		RegistryId:     aws.String(getRegistryId(ecrRepo)),
 	}
 
 	for {
-		params := &ecr.ListImagesInput{
-			RepositoryName: aws.String(name),
-			RegistryId:     aws.String(registryId),
+		resp, err := client.ListImages(params)
+		if err != nil {
+			return nil, err
+		}
+
+		imageIds = append(imageIds, resp.ImageIds...)
+
+		if resp.NextToken == nil {
+			break
+		}
+		params.NextToken = resp.NextToken
+	}
+
+	return imageIds, nil
+}
+
+// Removes tags from images in an ECR repository. Images left without any
+// tags are deleted by ECR.
+//
+// ecrRepo -- ECR registry the repository is in
+// name -- Name of the repository
+// tags -- Tags to remove
+// sess -- AWS session to use
+func DeleteImageTags(ecrRepo, name string, tags []string, sess *session.Session) error {
+	const batchSize = 100
+
+	client := ecr.New(sess)
+	for start := 0; start < len(tags); start += batchSize {
+		end := start + batchSize
+		if end > len(tags) {
+			end = len(tags)
 		}
 
-		if nextToken != "" {
-			params.NextToken = aws.String(nextToken)
+		var imageIds []*ecr.ImageIdentifier
+		for _, tag := range tags[start:end] {
+			imageIds = append(imageIds, &ecr.ImageIdentifier{ImageTag: aws.String(tag)})
 		}
 
-		resp, err := client.ListImages(params)
+		resp, err := client.BatchDeleteImage(&ecr.BatchDeleteImageInput{
+			RepositoryName: aws.String(name),
+			RegistryId:     aws.String(getRegistryId(ecrRepo)),
+			ImageIds:       imageIds,
+		})
 		if err != nil {
-			return "", err
+			return err
 		}
 
-		for _, v := range resp.ImageIds {
-			if aws.StringValue(v.ImageTag) == "" {
-				continue
-			}
-			tag := aws.StringValue(v.ImageTag)
-			match, err := regexp.MatchString(tagRegExp, tag)
-			if err != nil {
-				return "", err
+		for _, failure := range resp.Failures {
+			if aws.StringValue(failure.FailureCode) != ecr.ImageFailureCodeImageNotFound {
+				return fmt.Errorf("Unable to delete %s: %s", aws.StringValue(failure.ImageId.ImageTag), aws.StringValue(failure.FailureReason))
 			}
+		}
+	}
 
-			if match {
-				matches = append(matches, tag)
-			}
+	return nil
+}
+
+type batchGetImageInput struct {
+	_ struct{} `type:"structure"`
+
+	AcceptedMediaTypes []*string              `locationName:"acceptedMediaTypes" type:"list"`
+	ImageIds           []*ecr.ImageIdentifier `locationName:"imageIds" type:"list" required:"true"`
+	RegistryId         *string                `locationName:"registryId" type:"string"`
+	RepositoryName     *string                `locationName:"repositoryName" type:"string" required:"true"`
+}
+
+type batchGetImageOutput struct {
+	_ struct{} `type:"structure"`
+
+	Failures []*ecr.ImageFailure `locationName:"failures" type:"list"`
+	Images   []*ecrImage         `locationName:"images" type:"list"`
+}
+
+type ecrImage struct {
+	_ struct{} `type:"structure"`
+
+	ImageManifest          *string `locationName:"imageManifest" type:"string"`
+	ImageManifestMediaType *string `locationName:"imageManifestMediaType" type:"string"`
+}
+
+type putImageInput struct {
+	_ struct{} `type:"structure"`
+
+	ImageManifest          *string `locationName:"imageManifest" type:"string" required:"true"`
+	ImageManifestMediaType *string `locationName:"imageManifestMediaType" type:"string"`
+	ImageTag               *string `locationName:"imageTag" type:"string"`
+	RegistryId             *string `locationName:"registryId" type:"string"`
+	RepositoryName         *string `locationName:"repositoryName" type:"string" required:"true"`
+}
+
+type putImageOutput struct {
+	_ struct{} `type:"structure"`
+}
+
+// Reports whether two images are in the same ECR repository, so one can be
+// retagged as the other with RetagEcrImage.
+func SameEcrRepository(old, new string) bool {
+	oldRepo, _ := SplitImageName(old)
+	newRepo, _ := SplitImageName(new)
+
+	return oldRepo == newRepo && getRegistryRegion(oldRepo) != "" && !strings.Contains(new, "@")
+}
+
+// Adds a tag to an image in ECR by copying its manifest to the new tag. No
+// layers are transferred and no Docker daemon is needed. The vendored SDK
+// predates manifest media types on ECR images so the requests are built by
+// hand.
+//
+// old -- Full name of the image to tag
+// new -- Full name of the new tag, in the same repository as old
+// sess -- AWS session to use
+func RetagEcrImage(old, new string, sess *session.Session) error {
+	if !SameEcrRepository(old, new) {
+		return fmt.Errorf("%s and %s are not in the same ECR repository", old, new)
+	}
+
+	repo, reference := RegistryRepository(old)
+	_, newTag := RegistryRepository(new)
+	registryId := getRegistryId(registryHost(old))
+
+	imageId := &ecr.ImageIdentifier{ImageTag: aws.String(reference)}
+	if strings.Contains(reference, ":") {
+		imageId = &ecr.ImageIdentifier{ImageDigest: aws.String(reference)}
+	}
+
+	client := ecr.New(sess, aws.NewConfig().WithRegion(getRegistryRegion(old)))
+
+	getOp := &request.Operation{
+		Name:       "BatchGetImage",
+		HTTPMethod: "POST",
+		HTTPPath:   "/",
+	}
+
+	getInput := &batchGetImageInput{
+		AcceptedMediaTypes: aws.StringSlice([]string{MediaTypeManifestV2, MediaTypeManifestList, MediaTypeOCIManifest, MediaTypeOCIImageIndex, MediaTypeManifestV1}),
+		ImageIds:           []*ecr.ImageIdentifier{imageId},
+		RegistryId:         aws.String(registryId),
+		RepositoryName:     aws.String(repo),
+	}
+	getOutput := &batchGetImageOutput{}
+
+	if err := client.NewRequest(getOp, getInput, getOutput).Send(); err != nil {
+		return fmt.Errorf("Unable to look up %s: %s", old, err)
+	}
+
+	if len(getOutput.Images) == 0 {
+		reason := "image not found"
+		if len(getOutput.Failures) > 0 {
+			reason = aws.StringValue(getOutput.Failures[0].FailureReason)
 		}
+		return fmt.Errorf("Unable to look up %s: %s", old, reason)
+	}
+	image := getOutput.Images[0]
 
-		if resp.NextToken != nil {
-			nextToken = *resp.NextToken
-		} else {
-			break
+	putOp := &request.Operation{
+		Name:       "PutImage",
+		HTTPMethod: "POST",
+		HTTPPath:   "/",
+	}
+
+	putInput := &putImageInput{
+		ImageManifest:          image.ImageManifest,
+		ImageManifestMediaType: image.ImageManifestMediaType,
+		ImageTag:               aws.String(newTag),
+		RegistryId:             aws.String(registryId),
+		RepositoryName:         aws.String(repo),
+	}
+
+	err := client.NewRequest(putOp, putInput, &putImageOutput{}).Send()
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "ImageAlreadyExistsException" {
+		// The tag already points at this image
+	} else if err != nil {
+		return fmt.Errorf("Unable to tag %s as %s: %s", old, new, err)
+	}
+
+	// Recording the tag is only a convenience for a later push
+	if err := recordEcrRetag(new); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to record the new tag: %s\n", err)
+	}
+
+	return nil
+}
+
+// Reports whether an image was tagged in ECR by RetagEcrImage on this host
+// within the last day. Such tags are already published, so there is no local
+// image to push for them.
+//
+// image -- Full name of the image
+func RetaggedInEcr(image string) bool {
+	var retags map[string]time.Time
+	if !readCache(ecrRetagsCacheName, &retags) {
+		return false
+	}
+
+	taggedAt, ok := retags[image]
+	return ok && time.Since(taggedAt) < ecrRetagLifetime
+}
+
+func recordEcrRetag(image string) error {
+	retags := make(map[string]time.Time)
+	readCache(ecrRetagsCacheName, &retags)
+
+	for name, taggedAt := range retags {
+		if time.Since(taggedAt) >= ecrRetagLifetime {
+			delete(retags, name)
 		}
 	}
+	retags[image] = time.Now()
 
-	// Sort the matches and then return the last one which will be the latest
-	sort.Strings(matches)
+	return writeCache(ecrRetagsCacheName, retags)
+}
 
-	if len(matches) <= 0 {
-		return "", fmt.Errorf("No matching containers found")
-	} else {
-		return matches[len(matches)-1], nil
+// Returns the images in an ECR repository with build_tool tags the filter
+// accepts, ordered from the oldest tag to the newest. Tags that don't parse are
+// skipped.
+func findTaggedImages(ecrRepo, name string, filter func(Tag) bool, sess *session.Session) ([]*ecr.ImageIdentifier, error) {
+	var matches byTag
+
+	imageIds, err := ListImageIds(ecrRepo, name, sess)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, v := range imageIds {
+		tag, err := ParseTag(aws.StringValue(v.ImageTag))
+		if err == nil && filter(tag) {
+			matches.images = append(matches.images, v)
+			matches.tags = append(matches.tags, tag)
+		}
+	}
+
+	sort.Sort(matches)
+
+	return matches.images, nil
+}
+
+type byTag struct {
+	images []*ecr.ImageIdentifier
+	tags   []Tag
+}
+
+func (t byTag) Len() int { return len(t.images) }
+func (t byTag) Swap(i, j int) {
+	t.images[i], t.images[j] = t.images[j], t.images[i]
+	t.tags[i], t.tags[j] = t.tags[j], t.tags[i]
+}
+func (t byTag) Less(i, j int) bool { return t.tags[i].Before(t.tags[j]) }
+
+// Returns the images tagged as deployed to an environment ordered from the
+// oldest deploy to the newest.
+//
+// ecr -- Name of the AWS ECR to use
+// name -- Name of the repository in the ECR
+// env -- Environment to look up deploys for
+// sess -- AWS session to use
+func FindDeployTags(ecrRepo, name, env string, sess *session.Session) ([]*ecr.ImageIdentifier, error) {
+	return findTaggedImages(ecrRepo, name, func(t Tag) bool { return t.Kind == TagKindDeploy && t.Env == env }, sess)
+}
+
+// Creates a tag for an image that sorts after the tags from the same minute
+// already in an ECR repository. Jobs tagging at the same time can still pick
+// the same tag, and ECR moves a tag that's pushed again, so tags are only
+// unique when they're created one at a time.
+//
+// ecr -- Name of the AWS ECR to use
+// name -- Name of the repository in the ECR
+// tag -- Tag to start from
+// sess -- AWS session to use
+func NextImageTag(ecrRepo, name string, tag Tag, sess *session.Session) (Tag, error) {
+	imageIds, err := ListImageIds(ecrRepo, name, sess)
+	if err != nil {
+		return Tag{}, err
 	}
+
+	var existing []Tag
+	for _, v := range imageIds {
+		if t, err := ParseTag(aws.StringValue(v.ImageTag)); err == nil {
+			existing = append(existing, t)
+		}
+	}
+
+	return tag.Next(existing), nil
 }
 
-// Sets ECR Login credentials on the host for pushing and pulling docker
-// containers
+// Sets ECR Login credentials for pushing and pulling docker containers. The
+// credentials are handed to the Docker Engine API client in memory and are
+// cached on disk until the token expires.
 //
 // region -- AWS region to use
 // profile -- AWS profile to use
 // ecr -- Name of the ECR to use
 func EcrLogin(region, profile, ecr string) error {
-	var err error
-	loginCmdArgs := []string{"ecr", "get-login"}
+	auth, err := GetEcrCredentials(region, profile, ecr)
+	if err != nil {
+		return err
+	}
 
-	if region != "" {
-		loginCmdArgs = append(loginCmdArgs, "--region", region)
+	client, err := GetDockerClient()
+	if err != nil {
+		return err
 	}
+	client.SetRegistryAuth(ecr, auth)
+
+	return nil
+}
 
-	if profile != "" {
-		loginCmdArgs = append(loginCmdArgs, "--profile", profile)
+// Credentials for an ECR registry along with when they expire.
+type ecrToken struct {
+	Auth      RegistryAuth
+	ExpiresAt time.Time
+}
+
+func (t ecrToken) valid() bool {
+	return t.Auth.Password != "" && time.Now().Add(ecrTokenExpiryWindow).Before(t.ExpiresAt)
+}
+
+var ecrTokens = make(map[string]ecrToken)
+
+// Looks up credentials for an ECR registry using GetAuthorizationToken.
+// Tokens are reused from memory or the disk cache until they expire.
+//
+// region -- AWS region to use. Defaults to the region of the registry
+// profile -- AWS profile to use
+// ecr -- Name of the ECR to use
+func GetEcrCredentials(region, profile, ecrRepo string) (RegistryAuth, error) {
+	if region == "" {
+		region = getRegistryRegion(ecrRepo)
 	}
 
-	registryId := strings.Split(ecr, ".")[0]
-	loginCmdArgs = append(loginCmdArgs, "--registry-ids", registryId)
+	cacheName := fmt.Sprintf("ecr-%s-%s", profile, registryHost(ecrRepo))
+	return cachedEcrCredentials(cacheName, ecrRepo, func() (*session.Session, error) {
+		return GetAWSSession(region, profile)
+	})
+}
 
-	awsCmd, err := exec.LookPath("aws")
-	if err != nil {
-		return fmt.Errorf("Could not find aws command: %s")
+// Looks up credentials for an ECR registry using an environment's session,
+// so registries in other accounts can be reached through the environment's
+// role.
+//
+// profile -- AWS profile used to assume the environment's role
+// env -- Settings for the environment
+// ecr -- Name of the ECR to use
+func GetEnvEcrCredentials(profile string, env EnvConfig, ecrRepo string) (RegistryAuth, error) {
+	if env.RoleArn == "" {
+		return GetEcrCredentials("", profile, ecrRepo)
 	}
 
-	loginCmd := exec.Command(awsCmd, loginCmdArgs...)
+	cacheName := fmt.Sprintf("ecr-%s-%s-%s", profile, env.RoleArn, registryHost(ecrRepo))
+	return cachedEcrCredentials(cacheName, ecrRepo, func() (*session.Session, error) {
+		return GetEnvAWSSession(getRegistryRegion(ecrRepo), profile, env)
+	})
+}
+
+func cachedEcrCredentials(cacheName, ecrRepo string, newSession func() (*session.Session, error)) (RegistryAuth, error) {
+	registryId := getRegistryId(ecrRepo)
 
-	var out bytes.Buffer
-	loginCmd.Stdout = &out
+	if token, ok := ecrTokens[cacheName]; ok && token.valid() {
+		return token.Auth, nil
+	}
+
+	var token ecrToken
+	if readCache(cacheName, &token) && token.valid() {
+		ecrTokens[cacheName] = token
+		return token.Auth, nil
+	}
 
-	err = loginCmd.Run()
+	sess, err := newSession()
 	if err != nil {
-		return fmt.Errorf("Error getting login credentials for AWS ECR: %s", err)
+		return RegistryAuth{}, err
 	}
 
-	outputSlice := strings.Split(strings.TrimSpace(out.String()), " ")
-	dockerLoginArgs := outputSlice[1:]
-	dockerCmd, err := exec.LookPath("docker")
+	resp, err := ecr.New(sess).GetAuthorizationToken(&ecr.GetAuthorizationTokenInput{
+		RegistryIds: []*string{aws.String(registryId)},
+	})
 	if err != nil {
-		return fmt.Errorf("Could not find docker command: %s", err)
+		return RegistryAuth{}, fmt.Errorf("Error getting login credentials for AWS ECR: %s", err)
 	}
 
-	dockerLoginCmd := exec.Command(dockerCmd, dockerLoginArgs...)
-	dockerLoginCmd.Stdout = os.Stdout
-	dockerLoginCmd.Stderr = os.Stderr
+	if len(resp.AuthorizationData) == 0 {
+		return RegistryAuth{}, fmt.Errorf("No authorization data returned for registry %s", registryId)
+	}
+	data := resp.AuthorizationData[0]
 
-	err = dockerLoginCmd.Run()
+	decoded, err := base64.StdEncoding.DecodeString(aws.StringValue(data.AuthorizationToken))
 	if err != nil {
-		return fmt.Errorf("Error setting up login credentials with Docker: %s", err)
+		return RegistryAuth{}, fmt.Errorf("Unable to decode ECR authorization token: %s", err)
 	}
 
-	return nil
+	userPass := strings.SplitN(string(decoded), ":", 2)
+	if len(userPass) != 2 {
+		return RegistryAuth{}, fmt.Errorf("ECR authorization token is not of the form <user>:<password>")
+	}
+
+	token = ecrToken{
+		Auth: RegistryAuth{
+			Username:      userPass[0],
+			Password:      userPass[1],
+			ServerAddress: aws.StringValue(data.ProxyEndpoint),
+		},
+		ExpiresAt: aws.TimeValue(data.ExpiresAt),
+	}
+
+	// The token is still good when it can't be cached, the next run just
+	// has to ask for a new one
+	ecrTokens[cacheName] = token
+	if err := writeCache(cacheName, token); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to cache ECR credentials: %s\n", err)
+	}
+
+	return token.Auth, nil
+}
+
+// Returns the region of an ECR registry from its host name which is of the
+// form <registry id>.dkr.ecr.<region>.amazonaws.com
+func getRegistryRegion(ecr string) string {
+	hostParts := strings.Split(registryHost(ecr), ".")
+	if len(hostParts) > 3 && hostParts[1] == "dkr" && hostParts[2] == "ecr" {
+		return hostParts[3]
+	}
+
+	return ""
 }
@@ -0,0 +1,67 @@
+package utils
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+const cacheDirName = ".build_tool/cache"
+
+var cacheNameRegex = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+func cacheFile(name string) (string, error) {
+	home, err := homeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(home, cacheDirName, cacheNameRegex.ReplaceAllString(name, "_")+".json"), nil
+}
+
+// Returns the path of a file in the cache directory for state that must last
+// between runs but doesn't belong in the repository, such as a pipeline's
+// progress.
+//
+// name -- Name of the state, unsafe characters are replaced
+func StateFile(name string) (string, error) {
+	return cacheFile(name)
+}
+
+// Reads a cached value from disk into v. Returns false if nothing usable is
+// cached under the name.
+func readCache(name string, v interface{}) bool {
+	file, err := cacheFile(name)
+	if err != nil {
+		return false
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return false
+	}
+
+	return json.Unmarshal(data, v) == nil
+}
+
+// Writes a value to the on disk cache. The cache may hold credentials so it
+// is only readable by the current user.
+func writeCache(name string, v interface{}) error {
+	file, err := cacheFile(name)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(file, data, 0600)
+}
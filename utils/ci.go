@@ -0,0 +1,252 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+const maxDockerTagLength = 128
+
+var (
+	invalidTagChars = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+	githubPullRef   = regexp.MustCompile(`^refs/pull/([0-9]+)/`)
+)
+
+// What the CI system running the build knows about it. Fields the system
+// doesn't provide are left empty.
+type CIInfo struct {
+	Provider    string // Name of the CI system
+	JobTag      string // Docker tag unique to the run, shared by its steps
+	Branch      string // Branch being built
+	PullRequest string // Number of the pull or merge request being built
+	URL         string // Link to the run in the CI system
+	User        string // Who triggered the run
+}
+
+// A CI system build_tool knows how to read build information from.
+type CIProvider interface {
+	// Name of the CI system.
+	Name() string
+	// Reports whether the build is running under this CI system.
+	Detect() bool
+	// Reads the build information from the environment.
+	Info() CIInfo
+}
+
+var ciProviders = []CIProvider{
+	githubActionsCI{},
+	gitlabCI{},
+	circleCI{},
+	buildkiteCI{},
+	jenkinsCI{},
+}
+
+// Adds a CI provider. Providers added later are checked before the built in
+// ones.
+//
+// provider -- CI provider to add
+func RegisterCIProvider(provider CIProvider) {
+	ciProviders = append([]CIProvider{provider}, ciProviders...)
+}
+
+// Looks up the CI system the build is running under. When none is found an
+// empty CIInfo is returned.
+func DetectCI() CIInfo {
+	for _, provider := range ciProviders {
+		if !provider.Detect() {
+			continue
+		}
+
+		info := provider.Info()
+		info.Provider = provider.Name()
+		info.JobTag = sanitizeDockerTag(info.JobTag)
+		return info
+	}
+
+	return CIInfo{}
+}
+
+// Returns the labels describing the CI run, skipping anything the CI system
+// didn't provide.
+func (info CIInfo) Labels() []string {
+	var labels []string
+
+	values := [][2]string{
+		{CIProviderLabel, info.Provider},
+		{CIBranchLabel, info.Branch},
+		{CIPullRequestLabel, info.PullRequest},
+		{CIURLLabel, info.URL},
+		{CIUserLabel, info.User},
+	}
+	for _, kv := range values {
+		if kv[1] != "" {
+			labels = append(labels, fmt.Sprintf("%s=%s", kv[0], kv[1]))
+		}
+	}
+
+	return labels
+}
+
+// Turns a string into a valid docker tag by replacing the characters docker
+// doesn't allow.
+func sanitizeDockerTag(tag string) string {
+	tag = strings.Replace(tag, "%2F", "_", -1)
+	tag = invalidTagChars.ReplaceAllString(tag, "_")
+	tag = strings.TrimLeft(tag, ".-")
+	if len(tag) > maxDockerTagLength {
+		tag = tag[:maxDockerTagLength]
+	}
+	return tag
+}
+
+// Joins the non-empty parts of a job tag.
+func joinTagParts(parts ...string) string {
+	var nonEmpty []string
+	for _, part := range parts {
+		if part != "" {
+			nonEmpty = append(nonEmpty, part)
+		}
+	}
+	return strings.Join(nonEmpty, "-")
+}
+
+type jenkinsCI struct{}
+
+func (jenkinsCI) Name() string { return "jenkins" }
+
+func (jenkinsCI) Detect() bool {
+	return os.Getenv("JOB_NAME") != "" && os.Getenv("BUILD_NUMBER") != ""
+}
+
+func (jenkinsCI) Info() CIInfo {
+	branch := os.Getenv("BRANCH_NAME")
+	if branch == "" {
+		branch = strings.TrimPrefix(os.Getenv("GIT_BRANCH"), "origin/")
+	}
+
+	user := os.Getenv("BUILD_USER_ID")
+	if user == "" {
+		user = os.Getenv("CHANGE_AUTHOR")
+	}
+
+	return CIInfo{
+		JobTag:      joinTagParts(os.Getenv("JOB_NAME"), os.Getenv("BUILD_NUMBER")),
+		Branch:      branch,
+		PullRequest: os.Getenv("CHANGE_ID"),
+		URL:         os.Getenv("BUILD_URL"),
+		User:        user,
+	}
+}
+
+type githubActionsCI struct{}
+
+func (githubActionsCI) Name() string { return "github-actions" }
+
+func (githubActionsCI) Detect() bool {
+	return os.Getenv("GITHUB_ACTIONS") == "true"
+}
+
+func (githubActionsCI) Info() CIInfo {
+	repo := os.Getenv("GITHUB_REPOSITORY")
+
+	// Pull requests build a merge ref, the branch is in the head ref
+	branch := os.Getenv("GITHUB_HEAD_REF")
+	if branch == "" {
+		branch = os.Getenv("GITHUB_REF_NAME")
+	}
+	if branch == "" {
+		branch = strings.TrimPrefix(os.Getenv("GITHUB_REF"), "refs/heads/")
+	}
+
+	var pullRequest string
+	if match := githubPullRef.FindStringSubmatch(os.Getenv("GITHUB_REF")); match != nil {
+		pullRequest = match[1]
+	}
+
+	var url string
+	if server := os.Getenv("GITHUB_SERVER_URL"); server != "" && repo != "" {
+		url = fmt.Sprintf("%s/%s/actions/runs/%s", server, repo, os.Getenv("GITHUB_RUN_ID"))
+	}
+
+	return CIInfo{
+		JobTag:      joinTagParts(path.Base(repo), os.Getenv("GITHUB_JOB"), os.Getenv("GITHUB_RUN_ID"), os.Getenv("GITHUB_RUN_ATTEMPT")),
+		Branch:      branch,
+		PullRequest: pullRequest,
+		URL:         url,
+		User:        os.Getenv("GITHUB_ACTOR"),
+	}
+}
+
+type gitlabCI struct{}
+
+func (gitlabCI) Name() string { return "gitlab" }
+
+func (gitlabCI) Detect() bool {
+	return os.Getenv("GITLAB_CI") == "true"
+}
+
+func (gitlabCI) Info() CIInfo {
+	branch := os.Getenv("CI_MERGE_REQUEST_SOURCE_BRANCH_NAME")
+	if branch == "" {
+		branch = os.Getenv("CI_COMMIT_BRANCH")
+	}
+
+	return CIInfo{
+		JobTag:      joinTagParts(os.Getenv("CI_PROJECT_NAME"), os.Getenv("CI_PIPELINE_ID")),
+		Branch:      branch,
+		PullRequest: os.Getenv("CI_MERGE_REQUEST_IID"),
+		URL:         os.Getenv("CI_PIPELINE_URL"),
+		User:        os.Getenv("GITLAB_USER_LOGIN"),
+	}
+}
+
+type circleCI struct{}
+
+func (circleCI) Name() string { return "circleci" }
+
+func (circleCI) Detect() bool {
+	return os.Getenv("CIRCLECI") == "true"
+}
+
+func (circleCI) Info() CIInfo {
+	pullRequest := os.Getenv("CIRCLE_PR_NUMBER")
+	if pullRequest == "" {
+		if prURL := os.Getenv("CIRCLE_PULL_REQUEST"); prURL != "" {
+			pullRequest = path.Base(prURL)
+		}
+	}
+
+	return CIInfo{
+		JobTag:      joinTagParts(os.Getenv("CIRCLE_PROJECT_REPONAME"), os.Getenv("CIRCLE_BUILD_NUM"), os.Getenv("CIRCLE_NODE_INDEX")),
+		Branch:      os.Getenv("CIRCLE_BRANCH"),
+		PullRequest: pullRequest,
+		URL:         os.Getenv("CIRCLE_BUILD_URL"),
+		User:        os.Getenv("CIRCLE_USERNAME"),
+	}
+}
+
+type buildkiteCI struct{}
+
+func (buildkiteCI) Name() string { return "buildkite" }
+
+func (buildkiteCI) Detect() bool {
+	return os.Getenv("BUILDKITE") == "true"
+}
+
+func (buildkiteCI) Info() CIInfo {
+	pullRequest := os.Getenv("BUILDKITE_PULL_REQUEST")
+	if pullRequest == "false" {
+		pullRequest = ""
+	}
+
+	return CIInfo{
+		JobTag:      joinTagParts(os.Getenv("BUILDKITE_PIPELINE_SLUG"), os.Getenv("BUILDKITE_BUILD_NUMBER"), os.Getenv("BUILDKITE_PARALLEL_JOB")),
+		Branch:      os.Getenv("BUILDKITE_BRANCH"),
+		PullRequest: pullRequest,
+		URL:         os.Getenv("BUILDKITE_BUILD_URL"),
+		User:        os.Getenv("BUILDKITE_BUILD_CREATOR_EMAIL"),
+	}
+}
@@ -0,0 +1,271 @@
+package utils
+
+import (
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// Every variable the CI providers read, so each test starts from a clean
+// environment whichever CI system runs the tests.
+var ciVariables = []string{
+	"JOB_NAME", "BUILD_NUMBER", "BRANCH_NAME", "GIT_BRANCH", "BUILD_USER_ID", "CHANGE_AUTHOR", "CHANGE_ID", "BUILD_URL",
+	"GITHUB_ACTIONS", "GITHUB_REPOSITORY", "GITHUB_HEAD_REF", "GITHUB_REF_NAME", "GITHUB_REF", "GITHUB_SERVER_URL", "GITHUB_RUN_ID", "GITHUB_RUN_ATTEMPT", "GITHUB_JOB", "GITHUB_ACTOR",
+	"GITLAB_CI", "CI_MERGE_REQUEST_SOURCE_BRANCH_NAME", "CI_COMMIT_BRANCH", "CI_PROJECT_NAME", "CI_PIPELINE_ID", "CI_MERGE_REQUEST_IID", "CI_PIPELINE_URL", "GITLAB_USER_LOGIN",
+	"CIRCLECI", "CIRCLE_PR_NUMBER", "CIRCLE_PULL_REQUEST", "CIRCLE_PROJECT_REPONAME", "CIRCLE_BUILD_NUM", "CIRCLE_NODE_INDEX", "CIRCLE_BRANCH", "CIRCLE_BUILD_URL", "CIRCLE_USERNAME",
+	"BUILDKITE", "BUILDKITE_PULL_REQUEST", "BUILDKITE_PIPELINE_SLUG", "BUILDKITE_BUILD_NUMBER", "BUILDKITE_PARALLEL_JOB", "BUILDKITE_BRANCH", "BUILDKITE_BUILD_URL", "BUILDKITE_BUILD_CREATOR_EMAIL",
+}
+
+// Replaces the CI variables with the given ones and returns a function
+// putting the original environment back.
+func setCIEnv(vars map[string]string) func() {
+	saved := make(map[string]string)
+	for _, name := range ciVariables {
+		if value, ok := os.LookupEnv(name); ok {
+			saved[name] = value
+		}
+		os.Unsetenv(name)
+	}
+	for name, value := range vars {
+		os.Setenv(name, value)
+	}
+
+	return func() {
+		for _, name := range ciVariables {
+			os.Unsetenv(name)
+		}
+		for name, value := range saved {
+			os.Setenv(name, value)
+		}
+	}
+}
+
+func TestDetectCI(t *testing.T) {
+	tests := []struct {
+		name string
+		vars map[string]string
+		want CIInfo
+	}{
+		{
+			name: "jenkins",
+			vars: map[string]string{
+				"JOB_NAME":      "web",
+				"BUILD_NUMBER":  "42",
+				"GIT_BRANCH":    "origin/main",
+				"BUILD_URL":     "https://jenkins.example.com/job/web/42/",
+				"BUILD_USER_ID": "alice",
+			},
+			want: CIInfo{Provider: "jenkins", JobTag: "web-42", Branch: "main", URL: "https://jenkins.example.com/job/web/42/", User: "alice"},
+		},
+		{
+			name: "jenkins multibranch pull request",
+			vars: map[string]string{
+				"JOB_NAME":      "Team/web/PR-7",
+				"BUILD_NUMBER":  "3",
+				"BRANCH_NAME":   "PR-7",
+				"GIT_BRANCH":    "origin/feature/login",
+				"CHANGE_ID":     "7",
+				"CHANGE_AUTHOR": "bob",
+			},
+			want: CIInfo{Provider: "jenkins", JobTag: "Team_web_PR-7-3", Branch: "PR-7", PullRequest: "7", User: "bob"},
+		},
+		{
+			name: "github actions push",
+			vars: map[string]string{
+				"GITHUB_ACTIONS":     "true",
+				"GITHUB_REPOSITORY":  "example/web",
+				"GITHUB_REF":         "refs/heads/Feature/Login",
+				"GITHUB_REF_NAME":    "Feature/Login",
+				"GITHUB_SERVER_URL":  "https://github.com",
+				"GITHUB_RUN_ID":      "1234",
+				"GITHUB_RUN_ATTEMPT": "2",
+				"GITHUB_JOB":         "build",
+				"GITHUB_ACTOR":       "carol",
+			},
+			want: CIInfo{
+				Provider: "github-actions",
+				JobTag:   "web-build-1234-2",
+				Branch:   "Feature/Login",
+				URL:      "https://github.com/example/web/actions/runs/1234",
+				User:     "carol",
+			},
+		},
+		{
+			name: "github actions pull request",
+			vars: map[string]string{
+				"GITHUB_ACTIONS":    "true",
+				"GITHUB_REPOSITORY": "example/web",
+				"GITHUB_REF":        "refs/pull/15/merge",
+				"GITHUB_REF_NAME":   "15/merge",
+				"GITHUB_HEAD_REF":   "feature/login",
+				"GITHUB_RUN_ID":     "99",
+				"GITHUB_JOB":        "build",
+			},
+			want: CIInfo{Provider: "github-actions", JobTag: "web-build-99", Branch: "feature/login", PullRequest: "15"},
+		},
+		{
+			name: "github actions without a ref name",
+			vars: map[string]string{
+				"GITHUB_ACTIONS": "true",
+				"GITHUB_REF":     "refs/heads/main",
+				"GITHUB_RUN_ID":  "5",
+			},
+			want: CIInfo{Provider: "github-actions", JobTag: "5", Branch: "main"},
+		},
+		{
+			name: "gitlab merge request",
+			vars: map[string]string{
+				"GITLAB_CI":                           "true",
+				"CI_PROJECT_NAME":                     "web",
+				"CI_PIPELINE_ID":                      "777",
+				"CI_COMMIT_BRANCH":                    "main",
+				"CI_MERGE_REQUEST_SOURCE_BRANCH_NAME": "fix/Timeout",
+				"CI_MERGE_REQUEST_IID":                "12",
+				"CI_PIPELINE_URL":                     "https://gitlab.example.com/web/-/pipelines/777",
+				"GITLAB_USER_LOGIN":                   "dave",
+			},
+			want: CIInfo{
+				Provider:    "gitlab",
+				JobTag:      "web-777",
+				Branch:      "fix/Timeout",
+				PullRequest: "12",
+				URL:         "https://gitlab.example.com/web/-/pipelines/777",
+				User:        "dave",
+			},
+		},
+		{
+			name: "circleci",
+			vars: map[string]string{
+				"CIRCLECI":                "true",
+				"CIRCLE_PROJECT_REPONAME": "web",
+				"CIRCLE_BUILD_NUM":        "88",
+				"CIRCLE_NODE_INDEX":       "1",
+				"CIRCLE_BRANCH":           "feature/login",
+				"CIRCLE_PULL_REQUEST":     "https://github.com/example/web/pull/21",
+				"CIRCLE_BUILD_URL":        "https://circleci.com/gh/example/web/88",
+				"CIRCLE_USERNAME":         "erin",
+			},
+			want: CIInfo{
+				Provider:    "circleci",
+				JobTag:      "web-88-1",
+				Branch:      "feature/login",
+				PullRequest: "21",
+				URL:         "https://circleci.com/gh/example/web/88",
+				User:        "erin",
+			},
+		},
+		{
+			name: "buildkite",
+			vars: map[string]string{
+				"BUILDKITE":                     "true",
+				"BUILDKITE_PIPELINE_SLUG":       "web",
+				"BUILDKITE_BUILD_NUMBER":        "301",
+				"BUILDKITE_BRANCH":              "main",
+				"BUILDKITE_PULL_REQUEST":        "false",
+				"BUILDKITE_BUILD_URL":           "https://buildkite.com/example/web/builds/301",
+				"BUILDKITE_BUILD_CREATOR_EMAIL": "frank@example.com",
+			},
+			want: CIInfo{
+				Provider: "buildkite",
+				JobTag:   "web-301",
+				Branch:   "main",
+				URL:      "https://buildkite.com/example/web/builds/301",
+				User:     "frank@example.com",
+			},
+		},
+		{
+			name: "first detected provider wins",
+			vars: map[string]string{
+				"GITHUB_ACTIONS": "true",
+				"GITHUB_RUN_ID":  "1",
+				"JOB_NAME":       "web",
+				"BUILD_NUMBER":   "2",
+			},
+			want: CIInfo{Provider: "github-actions", JobTag: "1"},
+		},
+		{
+			name: "detection needs the exact flag",
+			vars: map[string]string{"GITLAB_CI": "1", "CIRCLECI": "yes", "JOB_NAME": "web"},
+			want: CIInfo{},
+		},
+		{
+			name: "no CI",
+			want: CIInfo{},
+		},
+	}
+
+	for _, test := range tests {
+		restore := setCIEnv(test.vars)
+		got := DetectCI()
+		restore()
+
+		if got != test.want {
+			t.Errorf("%s: DetectCI = %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestGetDockerJobTag(t *testing.T) {
+	restore := setCIEnv(nil)
+	if got := GetDockerJobTag(); got != defaultTag {
+		t.Errorf("GetDockerJobTag outside CI = %s, want %s", got, defaultTag)
+	}
+	restore()
+
+	restore = setCIEnv(map[string]string{"JOB_NAME": "web/feature%2FLogin", "BUILD_NUMBER": "4"})
+	defer restore()
+	if got := GetDockerJobTag(); got != "web_feature_Login-4" {
+		t.Errorf("GetDockerJobTag = %s, want web_feature_Login-4", got)
+	}
+}
+
+func TestSanitizeDockerTag(t *testing.T) {
+	tests := []struct {
+		tag  string
+		want string
+	}{
+		{"web-42", "web-42"},
+		{"feature/login", "feature_login"},
+		{"Feature/Login-Page", "Feature_Login-Page"},
+		{"team/web/feature%2FLogin-3", "team_web_feature_Login-3"},
+		{"release 1.2@beta", "release_1.2_beta"},
+		{".hidden-1", "hidden-1"},
+		{"--web", "web"},
+		{"_web", "_web"},
+		{strings.Repeat("a", 200), strings.Repeat("a", maxDockerTagLength)},
+		{"", ""},
+	}
+
+	for _, test := range tests {
+		got := sanitizeDockerTag(test.tag)
+		if got != test.want {
+			t.Errorf("sanitizeDockerTag(%q) = %q, want %q", test.tag, got, test.want)
+		}
+		if got != "" && !dockerTagGrammar.MatchString(got) {
+			t.Errorf("sanitizeDockerTag(%q) = %q, which isn't a valid tag", test.tag, got)
+		}
+	}
+}
+
+// Tags as the Docker reference grammar defines them
+var dockerTagGrammar = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+
+type fakeCI struct{}
+
+func (fakeCI) Name() string { return "fake" }
+func (fakeCI) Detect() bool { return os.Getenv("JOB_NAME") == "fake" }
+func (fakeCI) Info() CIInfo { return CIInfo{JobTag: "fake/Job"} }
+
+func TestRegisterCIProvider(t *testing.T) {
+	defer func(providers []CIProvider) { ciProviders = providers }(ciProviders)
+	RegisterCIProvider(fakeCI{})
+
+	restore := setCIEnv(map[string]string{"JOB_NAME": "fake", "BUILD_NUMBER": "1"})
+	defer restore()
+
+	want := CIInfo{Provider: "fake", JobTag: "fake_Job"}
+	if got := DetectCI(); got != want {
+		t.Errorf("DetectCI with a registered provider = %+v, want %+v", got, want)
+	}
+}
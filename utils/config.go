@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/BurntSushi/toml"
 )
@@ -12,18 +13,113 @@ const (
 	DefaultConfigFile = ".deploy/config.toml"
 	DefaultDockerfile = ".deploy/Dockerfile"
 	DefaultTestScript = ".deploy/tests.sh"
+
+	DeployModeCloudformation = "cloudformation"
+	DeployModeECS            = "ecs"
 )
 
 // Info from config file
 type Config struct {
-	Name         string              // Name of the service that will be created. Used for the name of the container
-	EcrRepo      string              // AWS Elastic Container Service Repository to use
-	Stack        string              // Name of the stack without the environment. Environment will be added later
-	CFTemplate   string              // Cloudformation template to use. S3 based should start with s3://
-	CFParameters map[string][]string // A set of key:value pairs for use with Cloudformation
-	TestScript   string              // Script used to execute tests. This should be relative to the Dockerfile WORKDIR
-	Dockerfile   string              // Should be relative to the repo root
-	Labels       []string            // A list of static labels to add to the docker container
+	Name         string               // Name of the service that will be created. Used for the name of the container
+	EcrRepo      string               // AWS Elastic Container Service Repository to use
+	Stack        string               // Name of the stack without the environment. Environment will be added later
+	CFTemplate   string               // Cloudformation template to use. S3 based should start with s3://
+	CFParameters map[string][]string  // A set of key:value pairs for use with Cloudformation
+	TestScript   string               // Script used to execute tests. This should be relative to the Dockerfile WORKDIR
+	Dockerfile   string               // Should be relative to the repo root
+	Labels       []string             // A list of static labels to add to the docker container
+	Envs         map[string]EnvConfig `toml:"env"` // Settings for each environment keyed by the environment name
+
+	ArtifactBucket string         // S3 bucket local templates are uploaded to before deploying
+	Lock           LockConfig     `toml:"lock"`     // Where deploy locks are kept
+	Preview        PreviewConfig  `toml:"preview"`  // Settings for per-branch preview environments
+	Pipeline       PipelineConfig `toml:"pipeline"` // Steps for the run command
+
+	Promotion map[string]PromotionConfig `toml:"promotion"` // Where each environment's images come from, keyed by the environment name
+}
+
+// Where an environment's images come from, from a [promotion.<name>] section
+type PromotionConfig struct {
+	From string   `toml:"from"` // Environment the images must have passed in. Empty for freshly built images
+	Kind string   `toml:"kind"` // Kind of tag to deploy from, build or pass. Defaults to pass when From is set, otherwise build
+	Soak Duration `toml:"soak"` // How long an image must have had its tag before it can be deployed
+
+	Registry string `toml:"registry"` // ECR registry the environment deploys from. Images are copied there from EcrRepo when promoted
+}
+
+// Steps for the run command from the [pipeline] section
+type PipelineConfig struct {
+	Steps     []PipelineStep `toml:"step"`       // Steps to run in order. Defaults to build, test, tag pass, push and deploy
+	StateFile string         `toml:"state_file"` // File the progress is saved to, relative to the repo root. Defaults to a file in ~/.build_tool/cache
+}
+
+// A single step from a [[pipeline.step]] section
+type PipelineStep struct {
+	Run         string   `toml:"run"`          // One of build, test, tag, push or deploy
+	Tag         string   `toml:"tag"`          // For tag steps, one of pass (the default), fail or deploy
+	DockerArgs  string   `toml:"docker_args"`  // For build steps, extra arguments for the docker build
+	SecretsFile string   `toml:"secrets_file"` // For test steps, the secrets file to use
+	Volumes     []string `toml:"volumes"`      // For test steps, extra volumes to add
+}
+
+// Settings for per-branch preview environments from the [preview] section
+type PreviewConfig struct {
+	BaseEnv    string   `toml:"base_env"`   // Environment whose settings and account previews use. Defaults to "stage"
+	Parameters []string `toml:"parameters"` // Cloudformation parameters for preview stacks as <key>=<value>
+}
+
+// Settings for deploy locks from the [lock] section
+type LockConfig struct {
+	Backend string   `toml:"backend"` // Either "file" or "dynamodb". Defaults to dynamodb when a table is set. File locks only work on a single host
+	Dir     string   `toml:"dir"`     // Directory for the file backend. Defaults to ~/.build_tool/locks
+	Table   string   `toml:"table"`   // DynamoDB table with a string hash key named "name"
+	TTL     Duration `toml:"ttl"`     // How long a lock outlives its holder before others can take it over. Held locks are renewed
+}
+
+// Settings for a single environment from an [env.<name>] section
+type EnvConfig struct {
+	RoleArn    string   `toml:"role_arn"`    // IAM role to assume when working in the environment's account
+	ExternalId string   `toml:"external_id"` // External ID required by the role's trust policy
+	MfaSerial  string   `toml:"mfa_serial"`  // MFA device to use when assuming the role
+	Timeout    Duration `toml:"timeout"`     // How long to wait for a deploy before cancelling it, e.g. "30m"
+
+	DeployMode    string `toml:"deploy_mode"`    // Either "cloudformation" (the default) or "ecs" to update the service directly
+	Cluster       string `toml:"cluster"`        // ECS cluster running the service. Defaults to "default"
+	Service       string `toml:"service"`        // ECS service to update. Defaults to the name of the stack
+	ContainerName string `toml:"container_name"` // Container in the task definition running the service's image
+
+	ArtifactBucket string `toml:"artifact_bucket"` // Overrides ArtifactBucket for the environment
+
+	StackTags             map[string]string `toml:"stack_tags"`             // Tags applied to the stack and its resources
+	Capabilities          []string          `toml:"capabilities"`           // Capabilities the template needs, e.g. CAPABILITY_IAM
+	NotificationArns      []string          `toml:"notification_arns"`      // SNS topics that receive the stack's events
+	StackPolicy           string            `toml:"stack_policy"`           // Stack policy file. Should be relative to the repo root
+	TerminationProtection *bool             `toml:"termination_protection"` // Protect the stack from deletion. Defaults to true for prod
+
+	HealthChecks []HealthCheckConfig `toml:"health_check"` // Checks run after a deploy. The previous container is redeployed if one fails
+}
+
+// A health check from an [[env.<name>.health_check]] section. Either URL or
+// Output must be set.
+type HealthCheckConfig struct {
+	URL            string   `toml:"url"`             // URL to request
+	Output         string   `toml:"output"`          // Cloudformation output holding the URL to request
+	Path           string   `toml:"path"`            // Path added to the URL from Output, e.g. "/health"
+	ExpectedStatus int      `toml:"expected_status"` // Status code a healthy service returns. Defaults to 200
+	BodyMatch      string   `toml:"body_match"`      // Regular expression the response body must match
+	Window         Duration `toml:"window"`          // How long to keep retrying before the check fails. Defaults to 2m
+	Interval       Duration `toml:"interval"`        // Time between attempts. Defaults to 5s
+}
+
+// A duration read from the config file as a string such as "1h30m"
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
 }
 
 func getConfigfile(configFile string) string {
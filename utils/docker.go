@@ -1,36 +1,26 @@
 package utils
 
 import (
-	"bytes"
 	"fmt"
 	"os"
-	"os/exec"
-	"strings"
 )
 
-// Push a container to a registry. This command does not login to the registry
-// that will be pushed to.
+// Push a container to a registry and return the digest of the pushed image.
+// This command does not login to the registry that will be pushed to.
 //
 // container -- Name of the container to be pushed
-func Push(container string) error {
-	var err error
-
-	dockerCmd, err := exec.LookPath("docker")
+func Push(container string) (string, error) {
+	client, err := GetDockerClient()
 	if err != nil {
-		return fmt.Errorf("Could not find docker command: %s", err)
+		return "", err
 	}
 
-	pushCmdArgs := []string{"push", container}
-	pushCmd := exec.Command(dockerCmd, pushCmdArgs...)
-	pushCmd.Stdout = os.Stdout
-	pushCmd.Stderr = os.Stderr
-
-	err = pushCmd.Run()
+	digest, err := client.ImagePush(container, os.Stdout)
 	if err != nil {
-		return fmt.Errorf("An error occurred pushing the container to ECR: %s", err)
+		return "", fmt.Errorf("An error occurred pushing the container to ECR: %s", err)
 	}
 
-	return nil
+	return digest, nil
 }
 
 // Tag a container with the new tag provided. This method will also pull the
@@ -41,8 +31,10 @@ func Push(container string) error {
 // region -- AWS region to use
 // profile -- AWS profile name to use
 func TagContainer(old, new, region, profile string) error {
-	var err error
-	tagCmdArgs := []string{"tag", old, new}
+	client, err := GetDockerClient()
+	if err != nil {
+		return err
+	}
 
 	if !localContainerFound(old) {
 		if err := Pull(old); err != nil {
@@ -50,17 +42,7 @@ func TagContainer(old, new, region, profile string) error {
 		}
 	}
 
-	dockerCmd, err := exec.LookPath("docker")
-	if err != nil {
-		return fmt.Errorf("Could not find docker command: %s", err)
-	}
-
-	dockerTagCmd := exec.Command(dockerCmd, tagCmdArgs...)
-	dockerTagCmd.Stdout = os.Stdout
-	dockerTagCmd.Stderr = os.Stderr
-
-	err = dockerTagCmd.Run()
-	if err != nil {
+	if err = client.ImageTag(old, new); err != nil {
 		return fmt.Errorf("Error tagging container with build date and repo: %s", err)
 	}
 
@@ -72,21 +54,13 @@ func TagContainer(old, new, region, profile string) error {
 //
 // container -- Name of the container to pull from a remote repository
 func Pull(container string) error {
-	var err error
-
-	fmt.Printf("Attempting to pull container: %s", container)
-	dockerCmd, err := exec.LookPath("docker")
+	fmt.Printf("Attempting to pull container: %s\n", container)
+	client, err := GetDockerClient()
 	if err != nil {
-		return fmt.Errorf("Could not find docker command: %s", err)
+		return err
 	}
 
-	pushCmdArgs := []string{"pull", container}
-	pushCmd := exec.Command(dockerCmd, pushCmdArgs...)
-	pushCmd.Stdout = os.Stdout
-	pushCmd.Stderr = os.Stderr
-
-	err = pushCmd.Run()
-	if err != nil {
+	if err = client.ImagePull(container, os.Stdout); err != nil {
 		return fmt.Errorf("An error occurred pulling the container: %s", err)
 	}
 
@@ -97,57 +71,24 @@ func Pull(container string) error {
 //
 // label -- The label to lookup for containers to delete
 func CleanUpByLabel(label string) error {
-	var output bytes.Buffer
-
-	dockerCmd, err := exec.LookPath("docker")
+	client, err := GetDockerClient()
 	if err != nil {
-		return fmt.Errorf("Could not find docker command: %s", err)
+		return err
 	}
 
-	findArgs := []string{"images", "-f", label, "--format={{.ID}}"}
-	findCmd := exec.Command(dockerCmd, findArgs...)
-	findCmd.Stdout = &output
-
-	err = findCmd.Run()
+	images, err := client.ImageList(map[string][]string{"label": {label}})
 	if err != nil {
 		return fmt.Errorf("Unable to find images using label '%s': %s", label, err)
 	}
 
-	ids := []string{}
-	for _, id := range strings.Split(output.String(), "\n") {
-		if len(ids) == 0 {
-			ids = append(ids, id)
-			continue
-		}
-		if id == "" {
-			continue
-		}
-
-		exists := false
-		for _, v := range ids {
-			if v == id {
-				exists = true
-			}
-		}
-		if !exists {
-			ids = append(ids, id)
-		}
-	}
-
-	if len(ids) == 0 {
+	if len(images) == 0 {
 		return fmt.Errorf("No images found")
 	}
 
-	rmiArgs := []string{"rmi", "-f"}
-	rmiArgs = append(rmiArgs, ids...)
-
-	rmiCmd := exec.Command(dockerCmd, rmiArgs...)
-	rmiCmd.Stdout = os.Stdout
-	rmiCmd.Stderr = os.Stderr
-
-	err = rmiCmd.Run()
-	if err != nil {
-		return fmt.Errorf("Unable to delete images: %s", err)
+	for _, image := range images {
+		if err := client.ImageRemove(image.ID, true); err != nil && !IsDockerNotFound(err) {
+			return fmt.Errorf("Unable to delete images: %s", err)
+		}
 	}
 
 	return nil
@@ -159,48 +100,32 @@ func CleanUpByLabel(label string) error {
 // tag -- Tag for the container
 // label -- Name of the label that contains the build date
 func GetContainerBuildDate(name, tag, label string) (string, error) {
-	var out bytes.Buffer
-
-	dockerCmd, err := exec.LookPath("docker")
+	client, err := GetDockerClient()
 	if err != nil {
 		return "", err
 	}
-	cmdArgs := []string{"inspect"}
-	cmdArgs = append(cmdArgs, fmt.Sprintf("--format='{{index .ContainerConfig.Labels \"%s\"}}'", label))
-	cmdArgs = append(cmdArgs, fmt.Sprintf("%s:%s", name, tag))
 
-	cmd := exec.Command(dockerCmd, cmdArgs...)
-	cmd.Stdout = &out
-	err = cmd.Run()
+	image, err := client.ImageInspect(fmt.Sprintf("%s:%s", name, tag))
 	if err != nil {
 		return "", err
 	}
-	return strings.TrimSpace(out.String()), nil
-}
-
-func localContainerFound(container string) bool {
-	var err error
-	var out bytes.Buffer
-
-	dockerCmd, err := exec.LookPath("docker")
-	if err != nil {
-		return false
-	}
 
-	imagesArgs := []string{"images", "--format={{.Repository}}:{{.Tag}}"}
+	return image.Label(label), nil
+}
 
-	cmd := exec.Command(dockerCmd, imagesArgs...)
-	cmd.Stdout = &out
+// Reports whether an image is in the local Docker daemon.
+//
+// container -- Name of the image to look for
+func LocalImageExists(container string) bool {
+	return localContainerFound(container)
+}
 
-	err = cmd.Run()
+func localContainerFound(container string) bool {
+	client, err := GetDockerClient()
 	if err != nil {
 		return false
 	}
 
-	for _, image := range strings.Split(out.String(), "\n") {
-		if strings.Compare(strings.TrimSpace(image), strings.TrimSpace(container)) == 0 {
-			return true
-		}
-	}
-	return false
+	_, err = client.ImageInspect(container)
+	return err == nil
 }
@@ -0,0 +1,868 @@
+package utils
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	DefaultDockerHost = "unix:///var/run/docker.sock"
+	dockerIndexServer = "https://index.docker.io/v1/"
+	dockerIgnoreFile  = ".dockerignore"
+)
+
+// Client for the Docker Engine API. Requests are sent to the daemon listening
+// on DOCKER_HOST or, when that isn't set, the default unix socket.
+type DockerClient struct {
+	client  *http.Client
+	scheme  string
+	host    string
+	version string
+	auths   map[string]RegistryAuth
+}
+
+// Credentials handed to the Docker Engine for talking to a registry.
+type RegistryAuth struct {
+	Username      string `json:"username,omitempty"`
+	Password      string `json:"password,omitempty"`
+	ServerAddress string `json:"serveraddress,omitempty"`
+}
+
+// Error returned by the Docker Engine API.
+type DockerError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *DockerError) Error() string {
+	return fmt.Sprintf("Docker API returned %d: %s", e.StatusCode, e.Message)
+}
+
+// A single message from a streaming Docker Engine API response such as a
+// build, push or pull.
+type JSONMessage struct {
+	Stream      string          `json:"stream,omitempty"`
+	Status      string          `json:"status,omitempty"`
+	Progress    string          `json:"progress,omitempty"`
+	ID          string          `json:"id,omitempty"`
+	Error       string          `json:"error,omitempty"`
+	ErrorDetail *JSONError      `json:"errorDetail,omitempty"`
+	Aux         json.RawMessage `json:"aux,omitempty"`
+}
+
+// Error reported in the middle of a streaming response.
+type JSONError struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+func (e *JSONError) Error() string {
+	return e.Message
+}
+
+// Image as returned when listing images.
+type ImageSummary struct {
+	ID       string            `json:"Id"`
+	RepoTags []string          `json:"RepoTags"`
+	Labels   map[string]string `json:"Labels"`
+	Created  int64             `json:"Created"`
+}
+
+// Image as returned when inspecting a single image.
+type ImageInspect struct {
+	ID              string           `json:"Id"`
+	RepoTags        []string         `json:"RepoTags"`
+	RepoDigests     []string         `json:"RepoDigests"`
+	Config          *ContainerConfig `json:"Config"`
+	ContainerConfig *ContainerConfig `json:"ContainerConfig"`
+}
+
+// Subset of an image's container configuration.
+type ContainerConfig struct {
+	Labels map[string]string `json:"Labels"`
+}
+
+// Options for building an image. Args are passed through as query parameters
+// on the build request.
+type BuildOptions struct {
+	Tag        string
+	Dockerfile string
+	Labels     map[string]string
+	BuildArgs  map[string]string
+	Args       url.Values
+}
+
+// Returns the label value for an image, preferring the image config over the
+// config of the container used to create the image.
+func (i *ImageInspect) Label(name string) string {
+	if i.Config != nil {
+		if v, ok := i.Config.Labels[name]; ok {
+			return v
+		}
+	}
+	if i.ContainerConfig != nil {
+		return i.ContainerConfig.Labels[name]
+	}
+	return ""
+}
+
+var dockerClient *DockerClient
+
+// Returns a shared Docker Engine API client, creating it on the first call.
+func GetDockerClient() (*DockerClient, error) {
+	var err error
+
+	if dockerClient == nil {
+		dockerClient, err = NewDockerClient()
+	}
+
+	return dockerClient, err
+}
+
+// Creates a Docker Engine API client using DOCKER_HOST, DOCKER_TLS_VERIFY,
+// DOCKER_CERT_PATH and DOCKER_API_VERSION from the environment.
+func NewDockerClient() (*DockerClient, error) {
+	dockerHost := os.Getenv("DOCKER_HOST")
+	if dockerHost == "" {
+		dockerHost = DefaultDockerHost
+	}
+
+	hostURL, err := url.Parse(dockerHost)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse DOCKER_HOST %s: %s", dockerHost, err)
+	}
+
+	c := &DockerClient{
+		scheme: "http",
+		auths:  make(map[string]RegistryAuth),
+	}
+	if version := os.Getenv("DOCKER_API_VERSION"); version != "" {
+		c.version = "/v" + strings.TrimPrefix(version, "v")
+	}
+
+	transport := &http.Transport{}
+	switch hostURL.Scheme {
+	case "unix":
+		socket := hostURL.Path
+		c.host = "docker"
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		}
+	case "tcp", "http", "https":
+		c.host = hostURL.Host
+		if hostURL.Scheme == "https" || os.Getenv("DOCKER_TLS_VERIFY") != "" {
+			tlsConfig, err := dockerTLSConfig(os.Getenv("DOCKER_CERT_PATH"))
+			if err != nil {
+				return nil, err
+			}
+			transport.TLSClientConfig = tlsConfig
+			c.scheme = "https"
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported DOCKER_HOST scheme: %s", hostURL.Scheme)
+	}
+
+	c.client = &http.Client{Transport: transport}
+
+	return c, nil
+}
+
+func dockerTLSConfig(certPath string) (*tls.Config, error) {
+	if certPath == "" {
+		home, err := homeDir()
+		if err != nil {
+			return nil, err
+		}
+		certPath = filepath.Join(home, ".docker")
+	}
+
+	cert, err := tls.LoadX509KeyPair(filepath.Join(certPath, "cert.pem"), filepath.Join(certPath, "key.pem"))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to load Docker client certificate: %s", err)
+	}
+
+	ca, err := ioutil.ReadFile(filepath.Join(certPath, "ca.pem"))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to load Docker CA certificate: %s", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(ca)
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+	}, nil
+}
+
+// Sets the credentials used when pushing to or pulling from a registry. These
+// take precedence over anything found in the Docker config file.
+func (c *DockerClient) SetRegistryAuth(registry string, auth RegistryAuth) {
+	c.auths[registryHost(registry)] = auth
+}
+
+func (c *DockerClient) do(method, path string, query url.Values, body io.Reader, header http.Header) (*http.Response, error) {
+	u := url.URL{
+		Scheme:   c.scheme,
+		Host:     c.host,
+		Path:     c.version + path,
+		RawQuery: query.Encode(),
+	}
+
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to reach the Docker daemon: %s", err)
+	}
+
+	if resp.StatusCode >= 400 {
+		defer resp.Body.Close()
+		return nil, readDockerError(resp)
+	}
+
+	return resp, nil
+}
+
+func readDockerError(resp *http.Response) error {
+	var apiErr struct {
+		Message string `json:"message"`
+	}
+
+	data, _ := ioutil.ReadAll(resp.Body)
+	if err := json.Unmarshal(data, &apiErr); err != nil || apiErr.Message == "" {
+		apiErr.Message = strings.TrimSpace(string(data))
+	}
+
+	return &DockerError{StatusCode: resp.StatusCode, Message: apiErr.Message}
+}
+
+// Checks if an error returned from the Docker Engine API was caused by a
+// missing image.
+func IsDockerNotFound(err error) bool {
+	dockerErr, ok := err.(*DockerError)
+	return ok && dockerErr.StatusCode == http.StatusNotFound
+}
+
+// Lists the images known by the daemon that match the given filters.
+func (c *DockerClient) ImageList(filters map[string][]string) ([]ImageSummary, error) {
+	var images []ImageSummary
+
+	query := url.Values{}
+	if len(filters) > 0 {
+		data, err := json.Marshal(filters)
+		if err != nil {
+			return nil, err
+		}
+		query.Set("filters", string(data))
+	}
+
+	resp, err := c.do("GET", "/images/json", query, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(&images); err != nil {
+		return nil, fmt.Errorf("Unable to decode image list: %s", err)
+	}
+
+	return images, nil
+}
+
+// Returns low level information about an image.
+func (c *DockerClient) ImageInspect(name string) (*ImageInspect, error) {
+	var image ImageInspect
+
+	resp, err := c.do("GET", "/images/"+name+"/json", nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(&image); err != nil {
+		return nil, fmt.Errorf("Unable to decode image %s: %s", name, err)
+	}
+
+	return &image, nil
+}
+
+// Adds the target name to the source image.
+func (c *DockerClient) ImageTag(source, target string) error {
+	repo, tag := SplitImageName(target)
+
+	query := url.Values{}
+	query.Set("repo", repo)
+	query.Set("tag", tag)
+
+	resp, err := c.do("POST", "/images/"+source+"/tag", query, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// Removes an image or one of its names from the daemon.
+func (c *DockerClient) ImageRemove(name string, force bool) error {
+	query := url.Values{}
+	if force {
+		query.Set("force", "1")
+	}
+
+	resp, err := c.do("DELETE", "/images/"+name, query, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// Pushes an image to its registry, writing progress to out. Returns the
+// digest reported by the registry.
+func (c *DockerClient) ImagePush(name string, out io.Writer) (string, error) {
+	var digest string
+
+	repo, tag := SplitImageName(name)
+
+	query := url.Values{}
+	query.Set("tag", tag)
+
+	header, err := c.authHeader(repo)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := c.do("POST", "/images/"+repo+"/push", query, nil, header)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	err = ReadJSONMessages(resp.Body, out, func(msg JSONMessage) {
+		var aux struct {
+			Digest string `json:"Digest"`
+		}
+		if len(msg.Aux) > 0 && json.Unmarshal(msg.Aux, &aux) == nil && aux.Digest != "" {
+			digest = aux.Digest
+		}
+	})
+
+	return digest, err
+}
+
+// Pulls an image from its registry, writing progress to out.
+func (c *DockerClient) ImagePull(name string, out io.Writer) error {
+	repo, tag := SplitImageName(name)
+
+	query := url.Values{}
+	query.Set("fromImage", repo)
+	query.Set("tag", tag)
+
+	header, err := c.authHeader(repo)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.do("POST", "/images/create", query, nil, header)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return ReadJSONMessages(resp.Body, out, nil)
+}
+
+// Builds an image from a tar archive of the build context, writing the build
+// output to out.
+func (c *DockerClient) ImageBuild(buildContext io.Reader, options BuildOptions, out io.Writer) error {
+	query := url.Values{}
+	for k, v := range options.Args {
+		query[k] = v
+	}
+	query.Set("t", options.Tag)
+	query.Set("dockerfile", options.Dockerfile)
+
+	if len(options.Labels) > 0 {
+		labels, err := json.Marshal(options.Labels)
+		if err != nil {
+			return err
+		}
+		query.Set("labels", string(labels))
+	}
+
+	if len(options.BuildArgs) > 0 {
+		buildArgs, err := json.Marshal(options.BuildArgs)
+		if err != nil {
+			return err
+		}
+		query.Set("buildargs", string(buildArgs))
+	}
+
+	header := http.Header{}
+	header.Set("Content-Type", "application/x-tar")
+
+	// Base images can come from any registry so hand every known credential
+	// to the daemon
+	authConfigs := c.loadDockerConfigAuths()
+	for host, auth := range c.auths {
+		authConfigs[host] = auth
+	}
+	if len(authConfigs) > 0 {
+		data, err := json.Marshal(authConfigs)
+		if err != nil {
+			return err
+		}
+		header.Set("X-Registry-Config", base64.URLEncoding.EncodeToString(data))
+	}
+
+	resp, err := c.do("POST", "/build", query, buildContext, header)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return ReadJSONMessages(resp.Body, out, nil)
+}
+
+func (c *DockerClient) authHeader(repo string) (http.Header, error) {
+	header := http.Header{}
+
+	auth, ok := c.registryAuth(repo)
+	if !ok {
+		// The daemon requires the header even for anonymous access
+		auth = RegistryAuth{}
+	}
+
+	data, err := json.Marshal(auth)
+	if err != nil {
+		return nil, err
+	}
+	header.Set("X-Registry-Auth", base64.URLEncoding.EncodeToString(data))
+
+	return header, nil
+}
+
+func (c *DockerClient) registryAuth(repo string) (RegistryAuth, bool) {
+	host := registryHost(repo)
+
+	if auth, ok := c.auths[host]; ok {
+		return auth, true
+	}
+
+	auth, ok := c.loadDockerConfigAuths()[host]
+	return auth, ok
+}
+
+// Reads the credentials stored in the auths section of the Docker config
+// file. Credential helpers are not supported.
+func (c *DockerClient) loadDockerConfigAuths() map[string]RegistryAuth {
+	var dockerConfig struct {
+		Auths map[string]struct {
+			Auth string `json:"auth"`
+		} `json:"auths"`
+	}
+	auths := make(map[string]RegistryAuth)
+
+	configFile, err := dockerConfigFile()
+	if err != nil {
+		return auths
+	}
+
+	data, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return auths
+	}
+
+	if err := json.Unmarshal(data, &dockerConfig); err != nil {
+		return auths
+	}
+
+	for server, entry := range dockerConfig.Auths {
+		decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+		if err != nil {
+			continue
+		}
+		userPass := strings.SplitN(string(decoded), ":", 2)
+		if len(userPass) != 2 {
+			continue
+		}
+		auths[registryHost(server)] = RegistryAuth{
+			Username:      userPass[0],
+			Password:      userPass[1],
+			ServerAddress: server,
+		}
+	}
+
+	return auths
+}
+
+func dockerConfigFile() (string, error) {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return filepath.Join(dir, "config.json"), nil
+	}
+
+	home, err := homeDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(home, ".docker", "config.json"), nil
+}
+
+// Reads a stream of JSON messages from the Docker Engine API and writes them
+// to out in a readable form. An error message in the stream is returned as
+// an error. If handler is given it is called with every message.
+func ReadJSONMessages(r io.Reader, out io.Writer, handler func(JSONMessage)) error {
+	if out == nil {
+		out = ioutil.Discard
+	}
+
+	decoder := json.NewDecoder(bufio.NewReader(r))
+	for {
+		var msg JSONMessage
+		if err := decoder.Decode(&msg); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("Unable to decode Docker API message: %s", err)
+		}
+
+		if handler != nil {
+			handler(msg)
+		}
+
+		if msg.ErrorDetail != nil && msg.ErrorDetail.Message != "" {
+			return msg.ErrorDetail
+		} else if msg.Error != "" {
+			return &JSONError{Message: msg.Error}
+		}
+
+		switch {
+		case msg.Stream != "":
+			fmt.Fprint(out, msg.Stream)
+		case msg.Status != "" && msg.ID != "":
+			fmt.Fprintf(out, "%s: %s %s\n", msg.ID, msg.Status, msg.Progress)
+		case msg.Status != "":
+			fmt.Fprintln(out, msg.Status)
+		}
+	}
+}
+
+// Splits an image name into the repository and the tag. The tag defaults to
+// latest when one isn't given.
+func SplitImageName(name string) (string, string) {
+	if i := strings.Index(name, "@"); i >= 0 {
+		return name[:i], name[i+1:]
+	}
+
+	i := strings.LastIndex(name, ":")
+	if i < 0 || strings.Contains(name[i+1:], "/") {
+		return name, defaultTag
+	}
+
+	return name[:i], name[i+1:]
+}
+
+// Returns the registry host for an image repository or registry address.
+func registryHost(name string) string {
+	name = strings.TrimPrefix(name, "https://")
+	name = strings.TrimPrefix(name, "http://")
+
+	host := strings.SplitN(name, "/", 2)[0]
+	if !strings.ContainsAny(host, ".:") && host != "localhost" {
+		return dockerIndexServer
+	}
+	if host == "index.docker.io" || host == "docker.io" {
+		return dockerIndexServer
+	}
+
+	return host
+}
+
+// Creates a tar archive of a build context directory. Files matching the
+// patterns in the directory's .dockerignore are skipped, except for the
+// Dockerfile and the .dockerignore itself which the daemon always needs.
+func TarBuildContext(dir, dockerfile string) (io.ReadCloser, error) {
+	excludes, err := readDockerignore(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeBuildContext(pw, dir, dockerfile, excludes))
+	}()
+
+	return pr, nil
+}
+
+func writeBuildContext(w io.Writer, dir, dockerfile string, excludes []dockerignorePattern) error {
+	tw := tar.NewWriter(w)
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+
+		if rel != dockerfile && rel != dockerIgnoreFile && dockerignoreMatches(excludes, rel) {
+			// Ignored directories are still walked when the Dockerfile or a
+			// file re-included with ! could be inside them
+			if info.IsDir() && !strings.HasPrefix(dockerfile, rel+"/") && !dockerignoreHasExceptionsBelow(excludes, rel) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = rel
+		if info.IsDir() {
+			header.Name += "/"
+		}
+
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
+
+// A .dockerignore pattern. Patterns follow Docker's rules: * and ? match
+// within a path element, ** matches any number of directories, a leading /
+// is ignored and patterns starting with ! re-include paths excluded by an
+// earlier pattern.
+type dockerignorePattern struct {
+	pattern   string
+	exception bool
+	regexp    *regexp.Regexp
+}
+
+func readDockerignore(dir string) ([]dockerignorePattern, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, dockerIgnoreFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Unable to read %s: %s", dockerIgnoreFile, err)
+	}
+
+	patterns, err := parseDockerignore(strings.Split(string(data), "\n"))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read %s: %s", dockerIgnoreFile, err)
+	}
+
+	return patterns, nil
+}
+
+func parseDockerignore(lines []string) ([]dockerignorePattern, error) {
+	var patterns []dockerignorePattern
+
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		p := dockerignorePattern{}
+		if strings.HasPrefix(line, "!") {
+			p.exception = true
+			line = strings.TrimSpace(line[1:])
+			if line == "" {
+				return nil, fmt.Errorf("Illegal exclusion pattern: !")
+			}
+		}
+
+		p.pattern = strings.TrimPrefix(filepath.ToSlash(filepath.Clean(line)), "/")
+		if p.pattern == "" {
+			p.pattern = "."
+		}
+
+		re, err := regexp.Compile(dockerignoreRegexp(p.pattern))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid pattern %s: %s", line, err)
+		}
+		p.regexp = re
+
+		patterns = append(patterns, p)
+	}
+
+	return patterns, nil
+}
+
+// Converts a .dockerignore pattern to a regular expression matching a whole
+// slash separated path.
+func dockerignoreRegexp(pattern string) string {
+	re := "^"
+
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '*':
+			if i+1 < len(pattern) && pattern[i+1] == '*' {
+				// ** matches any number of directories, so **/ can match nothing
+				i++
+				if i+1 < len(pattern) && pattern[i+1] == '/' {
+					i++
+				}
+				if i+1 == len(pattern) {
+					re += ".*"
+				} else {
+					re += "(.*/)?"
+				}
+			} else {
+				re += "[^/]*"
+			}
+		case '?':
+			re += "[^/]"
+		case '[':
+			// Character classes work the same in regular expressions
+			j := strings.IndexByte(pattern[i:], ']')
+			if j < 0 {
+				re += regexp.QuoteMeta(pattern[i:])
+				i = len(pattern)
+				break
+			}
+			re += pattern[i : i+j+1]
+			i += j
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+				re += regexp.QuoteMeta(pattern[i : i+1])
+			}
+		default:
+			re += regexp.QuoteMeta(pattern[i : i+1])
+		}
+	}
+
+	return re + "$"
+}
+
+// Checks whether a path or one of its parent directories matches the pattern.
+func (p dockerignorePattern) matches(path string) bool {
+	if p.regexp.MatchString(path) {
+		return true
+	}
+
+	for i := strings.LastIndex(path, "/"); i > 0; i = strings.LastIndex(path[:i], "/") {
+		if p.regexp.MatchString(path[:i]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Checks a slash separated path against .dockerignore patterns. A path is
+// also excluded when one of its parent directories matches. The last pattern
+// matching the path decides, so ! patterns re-include paths matched by an
+// earlier pattern.
+func dockerignoreMatches(patterns []dockerignorePattern, path string) bool {
+	excluded := false
+
+	for _, p := range patterns {
+		if p.matches(path) {
+			excluded = !p.exception
+		}
+	}
+
+	return excluded
+}
+
+// Checks whether a ! pattern could re-include something inside a directory.
+// A pattern with ** might match at any depth so it always could.
+func dockerignoreHasExceptionsBelow(patterns []dockerignorePattern, dir string) bool {
+	dirParts := strings.Split(dir, "/")
+
+	for _, p := range patterns {
+		if !p.exception {
+			continue
+		}
+
+		patternParts := strings.Split(p.pattern, "/")
+		below := true
+		for i, part := range dirParts {
+			if i < len(patternParts) && strings.Contains(patternParts[i], "**") {
+				return true
+			}
+			if i >= len(patternParts)-1 {
+				below = false
+				break
+			}
+			if matched, _ := filepath.Match(patternParts[i], part); !matched {
+				below = false
+				break
+			}
+		}
+		if below {
+			return true
+		}
+	}
+
+	return false
+}
+
+func homeDir() (string, error) {
+	if home := os.Getenv("HOME"); home != "" {
+		return home, nil
+	}
+	if home := os.Getenv("USERPROFILE"); home != "" {
+		return home, nil
+	}
+	return "", fmt.Errorf("Unable to find the home directory")
+}
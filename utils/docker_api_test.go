@@ -0,0 +1,232 @@
+package utils
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func mustParseDockerignore(t *testing.T, lines ...string) []dockerignorePattern {
+	patterns, err := parseDockerignore(lines)
+	if err != nil {
+		t.Fatalf("parseDockerignore(%v) returned an error: %s", lines, err)
+	}
+	return patterns
+}
+
+func TestDockerignoreMatches(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		path     string
+		want     bool
+	}{
+		{[]string{"node_modules"}, "node_modules", true},
+		{[]string{"node_modules"}, "node_modules/left-pad/index.js", true},
+		{[]string{"node_modules"}, "web/node_modules", false},
+		{[]string{"/node_modules"}, "node_modules/left-pad", true},
+		{[]string{"./node_modules/"}, "node_modules/left-pad", true},
+
+		{[]string{"**/node_modules"}, "node_modules", true},
+		{[]string{"**/node_modules"}, "web/node_modules", true},
+		{[]string{"**/node_modules"}, "web/app/node_modules/left-pad/index.js", true},
+		{[]string{"**/node_modules"}, "web/node_modules_backup", false},
+		{[]string{"**/*.log"}, "debug.log", true},
+		{[]string{"**/*.log"}, "logs/2024/debug.log", true},
+		{[]string{"**/*.log"}, "logs/debug.log.gz", false},
+		{[]string{"logs/**"}, "logs/2024/debug.log", true},
+		{[]string{"logs/**"}, "logs", false},
+		{[]string{"a/**/b"}, "a/b", true},
+		{[]string{"a/**/b"}, "a/x/y/b", true},
+		{[]string{"a/**/b"}, "c/a/b", false},
+		{[]string{"**"}, "anything/at/all", true},
+
+		{[]string{"*.md"}, "README.md", true},
+		{[]string{"*.md"}, "docs/README.md", false},
+		{[]string{"*/*.md"}, "docs/README.md", true},
+		{[]string{"*"}, "docs/README.md", true},
+		{[]string{"file?.txt"}, "file1.txt", true},
+		{[]string{"file?.txt"}, "file10.txt", false},
+		{[]string{"file[0-9].txt"}, "file5.txt", true},
+		{[]string{"file[0-9].txt"}, "filea.txt", false},
+		{[]string{"file[^0-9].txt"}, "filea.txt", true},
+		{[]string{`\*.txt`}, "*.txt", true},
+		{[]string{`\*.txt`}, "a.txt", false},
+		{[]string{"a.b"}, "axb", false},
+
+		{[]string{"*.md", "!README.md"}, "README.md", false},
+		{[]string{"*.md", "!README.md"}, "CHANGELOG.md", true},
+		{[]string{"!README.md", "*.md"}, "README.md", true},
+		{[]string{"docs", "!docs/keep.md"}, "docs/keep.md", false},
+		{[]string{"docs", "!docs/keep.md"}, "docs/other.md", true},
+		{[]string{"**/*.log", "!**/keep.log", "tmp"}, "web/keep.log", false},
+		{[]string{"**/*.log", "!**/keep.log", "tmp"}, "tmp/keep.log", true},
+		{[]string{"# a comment", "", "  build  "}, "build/out", true},
+	}
+
+	for _, test := range tests {
+		patterns := mustParseDockerignore(t, test.patterns...)
+		if got := dockerignoreMatches(patterns, test.path); got != test.want {
+			t.Errorf("dockerignoreMatches(%v, %s) = %t, want %t", test.patterns, test.path, got, test.want)
+		}
+	}
+}
+
+func TestParseDockerignoreInvalid(t *testing.T) {
+	for _, line := range []string{"!", "! "} {
+		if patterns, err := parseDockerignore([]string{line}); err == nil {
+			t.Errorf("parseDockerignore(%q) = %v, want an error", line, patterns)
+		}
+	}
+}
+
+func TestDockerignoreHasExceptionsBelow(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		dir      string
+		want     bool
+	}{
+		{[]string{"docs"}, "docs", false},
+		{[]string{"docs", "!docs/keep.md"}, "docs", true},
+		{[]string{"docs", "!docs/keep.md"}, "other", false},
+		{[]string{"docs", "!docs"}, "docs", false},
+		{[]string{"*", "!*/keep.md"}, "docs", true},
+		{[]string{"**/node_modules", "!**/node_modules/keep"}, "web/node_modules", true},
+	}
+
+	for _, test := range tests {
+		patterns := mustParseDockerignore(t, test.patterns...)
+		if got := dockerignoreHasExceptionsBelow(patterns, test.dir); got != test.want {
+			t.Errorf("dockerignoreHasExceptionsBelow(%v, %s) = %t, want %t", test.patterns, test.dir, got, test.want)
+		}
+	}
+}
+
+// Creates the given files in a new directory and returns the names of the
+// entries in its build context.
+func buildContextEntries(t *testing.T, files map[string]string, dockerfile string) []string {
+	dir, err := ioutil.TempDir("", "context")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	context, err := TarBuildContext(dir, dockerfile)
+	if err != nil {
+		t.Fatalf("TarBuildContext returned an error: %s", err)
+	}
+	defer context.Close()
+
+	var entries []string
+	tr := tar.NewReader(context)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("Unable to read the build context: %s", err)
+		}
+		if !strings.HasSuffix(header.Name, "/") {
+			entries = append(entries, header.Name)
+		}
+	}
+	sort.Strings(entries)
+
+	return entries
+}
+
+func TestTarBuildContext(t *testing.T) {
+	tests := []struct {
+		name       string
+		files      map[string]string
+		dockerfile string
+		want       []string
+	}{
+		{
+			name: "no dockerignore",
+			files: map[string]string{
+				"Dockerfile":   "FROM scratch",
+				"main.go":      "package main",
+				"web/index.js": "",
+			},
+			dockerfile: "Dockerfile",
+			want:       []string{"Dockerfile", "main.go", "web/index.js"},
+		},
+		{
+			name: "nested patterns",
+			files: map[string]string{
+				".dockerignore":                     "**/node_modules\n**/*.log\n/.git\n",
+				"Dockerfile":                        "FROM scratch",
+				"app.js":                            "",
+				"debug.log":                         "",
+				".git/HEAD":                         "",
+				"node_modules/left-pad/index.js":    "",
+				"web/node_modules/react/index.js":   "",
+				"web/src/app.js":                    "",
+				"web/src/logs/server.log":           "",
+				"web/src/node_modules_notes/app.md": "",
+			},
+			dockerfile: "Dockerfile",
+			want:       []string{".dockerignore", "Dockerfile", "app.js", "web/src/app.js", "web/src/node_modules_notes/app.md"},
+		},
+		{
+			name: "exceptions",
+			files: map[string]string{
+				".dockerignore":   "docs\n!docs/api/*.md\n*.md\n!README.md\n",
+				"Dockerfile":      "FROM scratch",
+				"README.md":       "",
+				"CHANGES.md":      "",
+				"docs/guide.txt":  "",
+				"docs/api/v1.md":  "",
+				"docs/api/v1.txt": "",
+			},
+			dockerfile: "Dockerfile",
+			want:       []string{".dockerignore", "Dockerfile", "README.md", "docs/api/v1.md"},
+		},
+		{
+			name: "dockerfile in an ignored directory",
+			files: map[string]string{
+				".dockerignore":           "build\n**/*.tmp\n",
+				"build/docker/Dockerfile": "FROM scratch",
+				"build/docker/entry.sh":   "",
+				"build/docker/cache.tmp":  "",
+				"main.go":                 "package main",
+			},
+			dockerfile: "build/docker/Dockerfile",
+			want:       []string{".dockerignore", "build/docker/Dockerfile", "main.go"},
+		},
+		{
+			name: "dockerfile matching a pattern",
+			files: map[string]string{
+				".dockerignore": "*\n!main.go\n",
+				"Dockerfile":    "FROM scratch",
+				"main.go":       "package main",
+				"notes.txt":     "",
+			},
+			dockerfile: "Dockerfile",
+			want:       []string{".dockerignore", "Dockerfile", "main.go"},
+		},
+	}
+
+	for _, test := range tests {
+		got := buildContextEntries(t, test.files, test.dockerfile)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: build context has %v, want %v", test.name, got, test.want)
+		}
+	}
+}
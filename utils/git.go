@@ -2,8 +2,11 @@ package utils
 
 import (
 	"bytes"
+	"fmt"
 	"os/exec"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // Find the git SHA for a given tag
@@ -37,3 +40,84 @@ func GitToplevel() (string, error) {
 	err = cmd.Run()
 	return strings.TrimSpace(out.String()), err
 }
+
+// Finds the name of the branch checked out in the current repository.
+func GitBranch() (string, error) {
+	var out bytes.Buffer
+	git, err := exec.LookPath("git")
+	if err != nil {
+		return "", err
+	}
+
+	cmd := exec.Command(git, "rev-parse", "--abbrev-ref", "HEAD")
+	cmd.Stdout = &out
+
+	if err := cmd.Run(); err != nil {
+		return "", err
+	}
+
+	branch := strings.TrimSpace(out.String())
+	if branch == "HEAD" {
+		return "", fmt.Errorf("HEAD is detached so the branch is unknown")
+	}
+
+	return branch, nil
+}
+
+// A single commit from the git log.
+type GitCommit struct {
+	SHA     string
+	Author  string
+	Email   string
+	Date    time.Time
+	Subject string
+}
+
+// Lists the commits reachable from to but not from from, newest first. The
+// log is read from the repository the current directory is in.
+//
+// from -- Commit the log starts after
+// to -- Commit the log ends at
+func GitLog(from, to string) ([]GitCommit, error) {
+	var out, stderr bytes.Buffer
+	git, err := exec.LookPath("git")
+	if err != nil {
+		return nil, err
+	}
+
+	repoTopLevel, err := GitToplevel()
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command(git, "-C", repoTopLevel, "log", "--no-merges", "--format=%h%x1f%an%x1f%ae%x1f%at%x1f%s%x1e", fmt.Sprintf("%s..%s", from, to))
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("Unable to read the git log between %s and %s, the commits may need to be fetched: %s", from, to, strings.TrimSpace(stderr.String()))
+	}
+
+	var commits []GitCommit
+	for _, record := range strings.Split(out.String(), "\x1e") {
+		fields := strings.Split(strings.TrimSpace(record), "\x1f")
+		if len(fields) != 5 {
+			continue
+		}
+
+		timestamp, err := strconv.ParseInt(fields[3], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse the date of commit %s: %s", fields[0], err)
+		}
+
+		commits = append(commits, GitCommit{
+			SHA:     fields[0],
+			Author:  fields[1],
+			Email:   fields[2],
+			Date:    time.Unix(timestamp, 0),
+			Subject: fields[4],
+		})
+	}
+
+	return commits, nil
+}
@@ -0,0 +1,108 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+const (
+	DefaultHealthCheckWindow   = 2 * time.Minute
+	DefaultHealthCheckInterval = 5 * time.Second
+	healthCheckRequestTimeout  = 10 * time.Second
+
+	// Only the start of a response body is matched against
+	maxHealthCheckBody = 1 << 20
+)
+
+// An HTTP request that must succeed for a deploy to be considered healthy.
+type HealthCheck struct {
+	URL            string
+	ExpectedStatus int
+	BodyMatch      *regexp.Regexp
+	Window         time.Duration
+	Interval       time.Duration
+}
+
+// Creates a health check for a URL from its config, filling in defaults.
+//
+// url -- URL to request
+// config -- Settings for the check
+func NewHealthCheck(url string, config HealthCheckConfig) (HealthCheck, error) {
+	check := HealthCheck{
+		URL:            url,
+		ExpectedStatus: config.ExpectedStatus,
+		Window:         config.Window.Duration,
+		Interval:       config.Interval.Duration,
+	}
+
+	if check.ExpectedStatus == 0 {
+		check.ExpectedStatus = http.StatusOK
+	}
+	if check.Window == 0 {
+		check.Window = DefaultHealthCheckWindow
+	}
+	if check.Interval == 0 {
+		check.Interval = DefaultHealthCheckInterval
+	}
+
+	if config.BodyMatch != "" {
+		var err error
+		check.BodyMatch, err = regexp.Compile(config.BodyMatch)
+		if err != nil {
+			return check, fmt.Errorf("Invalid body_match for %s: %s", url, err)
+		}
+	}
+
+	return check, nil
+}
+
+// Requests the check's URL until it returns the expected status and body or
+// the window runs out. Returns the reason the last attempt failed when the
+// check never passes.
+//
+// client -- HTTP client to use. Defaults to a client with a short timeout
+func (c HealthCheck) Run(client *http.Client) error {
+	if client == nil {
+		client = &http.Client{Timeout: healthCheckRequestTimeout}
+	}
+
+	deadline := time.Now().Add(c.Window)
+	for {
+		err := c.attempt(client)
+		if err == nil {
+			return nil
+		}
+
+		if time.Now().Add(c.Interval).After(deadline) {
+			return fmt.Errorf("%s is not healthy after %s: %s", c.URL, c.Window, err)
+		}
+		time.Sleep(c.Interval)
+	}
+}
+
+func (c HealthCheck) attempt(client *http.Client) error {
+	resp, err := client.Get(c.URL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxHealthCheckBody))
+	if err != nil {
+		return fmt.Errorf("Unable to read the response: %s", err)
+	}
+
+	if resp.StatusCode != c.ExpectedStatus {
+		return fmt.Errorf("Expected status %d but got %d", c.ExpectedStatus, resp.StatusCode)
+	}
+
+	if c.BodyMatch != nil && !c.BodyMatch.Match(body) {
+		return fmt.Errorf("Response body does not match %s", c.BodyMatch)
+	}
+
+	return nil
+}
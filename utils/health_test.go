@@ -0,0 +1,131 @@
+package utils
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHealthCheckRun(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		body      string
+		expected  int
+		bodyMatch string
+		wantErr   string
+	}{
+		{name: "ok", status: 200, body: "ok", expected: 200},
+		{name: "other expected status", status: 204, expected: 204},
+		{name: "wrong status", status: 503, body: "down", expected: 200, wantErr: "Expected status 200 but got 503"},
+		{name: "body matches", status: 200, body: `{"status": "green"}`, expected: 200, bodyMatch: `"status": "green"`},
+		{name: "body doesn't match", status: 200, body: `{"status": "red"}`, expected: 200, bodyMatch: `"status": "green"`, wantErr: "Response body does not match"},
+	}
+
+	for _, test := range tests {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(test.status)
+			fmt.Fprint(w, test.body)
+		}))
+
+		check := HealthCheck{
+			URL:            srv.URL,
+			ExpectedStatus: test.expected,
+			Window:         50 * time.Millisecond,
+			Interval:       10 * time.Millisecond,
+		}
+		if test.bodyMatch != "" {
+			check.BodyMatch = regexp.MustCompile(test.bodyMatch)
+		}
+
+		err := check.Run(srv.Client())
+		if test.wantErr == "" && err != nil {
+			t.Errorf("%s: Run returned an error: %s", test.name, err)
+		} else if test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+			t.Errorf("%s: Run = %v, want an error containing %q", test.name, err, test.wantErr)
+		}
+
+		srv.Close()
+	}
+}
+
+func TestHealthCheckRunRetries(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The service comes up on the third request
+		if atomic.AddInt32(&requests, 1) < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		fmt.Fprint(w, "ok")
+	}))
+	defer srv.Close()
+
+	check := HealthCheck{
+		URL:            srv.URL,
+		ExpectedStatus: http.StatusOK,
+		Window:         time.Second,
+		Interval:       10 * time.Millisecond,
+	}
+
+	if err := check.Run(srv.Client()); err != nil {
+		t.Fatalf("Run returned an error: %s", err)
+	}
+	if got := atomic.LoadInt32(&requests); got != 3 {
+		t.Errorf("Run made %d requests, want 3", got)
+	}
+}
+
+func TestHealthCheckRunTimeout(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		time.Sleep(100 * time.Millisecond)
+		fmt.Fprint(w, "ok")
+	}))
+	defer srv.Close()
+
+	check := HealthCheck{
+		URL:            srv.URL,
+		ExpectedStatus: http.StatusOK,
+		Window:         100 * time.Millisecond,
+		Interval:       20 * time.Millisecond,
+	}
+
+	client := srv.Client()
+	client.Timeout = 20 * time.Millisecond
+
+	start := time.Now()
+	err := check.Run(client)
+	if err == nil {
+		t.Fatal("Run of a check that times out should return an error")
+	}
+	if !strings.Contains(err.Error(), "is not healthy after") {
+		t.Errorf("Run = %s, want the window in the error", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Run took %s, want it to give up after the window", elapsed)
+	}
+	if got := atomic.LoadInt32(&requests); got < 2 {
+		t.Errorf("Run made %d requests, want it to retry after a timeout", got)
+	}
+}
+
+func TestNewHealthCheckDefaults(t *testing.T) {
+	check, err := NewHealthCheck("http://example.com/health", HealthCheckConfig{})
+	if err != nil {
+		t.Fatalf("NewHealthCheck returned an error: %s", err)
+	}
+	if check.ExpectedStatus != http.StatusOK || check.Window != DefaultHealthCheckWindow || check.Interval != DefaultHealthCheckInterval {
+		t.Errorf("NewHealthCheck = %+v, want the defaults", check)
+	}
+
+	if _, err := NewHealthCheck("http://example.com/health", HealthCheckConfig{BodyMatch: "("}); err == nil {
+		t.Error("NewHealthCheck with an invalid body_match should return an error")
+	}
+}
@@ -0,0 +1,130 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Copies an image between registries with the registry HTTP API, without
+// pulling it through a Docker daemon. Blobs the destination already has are
+// skipped, and the manifest is read back from the destination to check its
+// digest. Returns the digest of the copied manifest.
+//
+// src -- Client for the source registry
+// dst -- Client for the destination registry
+// srcImage -- Full name of the image to copy
+// dstImage -- Full name to copy the image to
+// out -- Where progress is written
+func CopyImage(src, dst *RegistryClient, srcImage, dstImage string, out io.Writer) (string, error) {
+	srcRepo, srcRef := RegistryRepository(srcImage)
+	dstRepo, dstRef := RegistryRepository(dstImage)
+
+	c := imageCopier{src: src, dst: dst, srcRepo: srcRepo, dstRepo: dstRepo, out: out}
+	return c.copyManifest(srcRef, dstRef)
+}
+
+type imageCopier struct {
+	src, dst         *RegistryClient
+	srcRepo, dstRepo string
+	out              io.Writer
+}
+
+func (c imageCopier) copyManifest(srcRef, dstRef string) (string, error) {
+	manifest, raw, mediaType, err := c.src.GetManifest(c.srcRepo, srcRef)
+	if err != nil {
+		return "", err
+	}
+	digest := manifestDigest(raw)
+	if strings.HasPrefix(srcRef, "sha256:") && srcRef != digest {
+		return "", fmt.Errorf("Manifest %s has digest %s", srcRef, digest)
+	}
+
+	var blobs []Descriptor
+	switch {
+	case mediaType == MediaTypeManifestList || mediaType == MediaTypeOCIImageIndex:
+		// Every image in the list has to be in the destination before the
+		// list itself
+		for _, m := range manifest.Manifests {
+			if _, err := c.copyManifest(m.Digest, m.Digest); err != nil {
+				return "", err
+			}
+		}
+	case manifest.SchemaVersion == 1:
+		for _, layer := range manifest.FSLayers {
+			blobs = append(blobs, Descriptor{Digest: layer.BlobSum, Size: -1})
+		}
+	default:
+		blobs = append(blobs, manifest.Config)
+		blobs = append(blobs, manifest.Layers...)
+	}
+
+	copied := make(map[string]bool)
+	for _, blob := range blobs {
+		// Foreign layers are fetched from their URLs, not the registry
+		if copied[blob.Digest] || len(blob.URLs) > 0 {
+			continue
+		}
+		if err := c.copyBlob(blob); err != nil {
+			return "", err
+		}
+		copied[blob.Digest] = true
+	}
+
+	if _, err := c.dst.PutManifest(c.dstRepo, dstRef, mediaType, raw); err != nil {
+		return "", fmt.Errorf("Unable to upload manifest %s: %s", dstRef, err)
+	}
+
+	// Signed schema 1 manifests may be signed again by the destination so
+	// their bytes can't be compared
+	if manifest.SchemaVersion == 1 {
+		return digest, nil
+	}
+
+	_, copiedRaw, _, err := c.dst.GetManifest(c.dstRepo, dstRef)
+	if err != nil {
+		return "", fmt.Errorf("Unable to check the copied manifest %s: %s", dstRef, err)
+	}
+	if copiedDigest := manifestDigest(copiedRaw); copiedDigest != digest {
+		return "", fmt.Errorf("Copied manifest %s has digest %s, expected %s", dstRef, copiedDigest, digest)
+	}
+
+	return digest, nil
+}
+
+func (c imageCopier) copyBlob(blob Descriptor) error {
+	exists, err := c.dst.BlobExists(c.dstRepo, blob.Digest)
+	if err != nil {
+		return fmt.Errorf("Unable to check for blob %s: %s", blob.Digest, err)
+	}
+	if exists {
+		fmt.Fprintf(c.out, "%s: already exists\n", shortDigest(blob.Digest))
+		return nil
+	}
+
+	content, err := c.src.GetBlob(c.srcRepo, blob.Digest)
+	if err != nil {
+		return fmt.Errorf("Unable to download blob %s: %s", blob.Digest, err)
+	}
+	defer content.Close()
+
+	if err := c.dst.PutBlob(c.dstRepo, blob.Digest, blob.Size, content); err != nil {
+		return fmt.Errorf("Unable to upload blob %s: %s", blob.Digest, err)
+	}
+
+	fmt.Fprintf(c.out, "%s: copied\n", shortDigest(blob.Digest))
+	return nil
+}
+
+func manifestDigest(raw []byte) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(raw))
+}
+
+func shortDigest(digest string) string {
+	digest = strings.TrimPrefix(digest, "sha256:")
+	if len(digest) > 12 {
+		return digest[:12]
+	}
+	return digest
+}
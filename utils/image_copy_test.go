@@ -0,0 +1,364 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// An in-memory registry that asks for bearer tokens like Docker Hub and ECR
+// do. Pushes need a token with push access.
+type fakeRegistry struct {
+	mu        sync.Mutex
+	blobs     map[string][]byte
+	manifests map[string][]byte
+	types     map[string]string
+	uploads   map[string][]byte
+	uploaded  []string
+
+	// Changes manifests as they're stored, like a registry converting them
+	rewriteManifest func([]byte) []byte
+}
+
+func newFakeRegistry() *fakeRegistry {
+	return &fakeRegistry{
+		blobs:     make(map[string][]byte),
+		manifests: make(map[string][]byte),
+		types:     make(map[string]string),
+		uploads:   make(map[string][]byte),
+	}
+}
+
+func (f *fakeRegistry) addBlob(content []byte) Descriptor {
+	digest := manifestDigest(content)
+	f.blobs[digest] = content
+	return Descriptor{Digest: digest, Size: int64(len(content))}
+}
+
+func (f *fakeRegistry) addManifest(reference, mediaType string, raw []byte) {
+	f.manifests[reference] = raw
+	f.types[reference] = mediaType
+	f.manifests[manifestDigest(raw)] = raw
+	f.types[manifestDigest(raw)] = mediaType
+}
+
+func (f *fakeRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.URL.Path == "/token" {
+		fmt.Fprintf(w, `{"token": "token-%s"}`, r.URL.Query().Get("scope"))
+		return
+	}
+
+	scope := "repository:app:pull"
+	if r.Method != "GET" && r.Method != "HEAD" {
+		scope = "repository:app:pull,push"
+	}
+	if r.Header.Get("Authorization") != "Bearer token-"+scope && r.Header.Get("Authorization") != "Bearer token-repository:app:pull,push" {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="https://%s/token",service="fake",scope="%s"`, r.Host, scope))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	path := r.URL.Path
+	name := path[strings.LastIndex(path, "/")+1:]
+
+	switch {
+	case strings.HasPrefix(path, "/v2/app/blobs/uploads/"):
+		switch r.Method {
+		case "POST":
+			w.Header().Set("Location", "/v2/app/blobs/uploads/upload-1?_state=started")
+			w.WriteHeader(http.StatusAccepted)
+		case "PATCH":
+			content, _ := ioutil.ReadAll(r.Body)
+			f.uploads[name] = append(f.uploads[name], content...)
+			w.Header().Set("Location", path+"?_state=patched")
+			w.WriteHeader(http.StatusAccepted)
+		case "PUT":
+			digest := r.URL.Query().Get("digest")
+			if r.URL.Query().Get("_state") != "patched" || manifestDigest(f.uploads[name]) != digest {
+				http.Error(w, `{"errors": [{"code": "DIGEST_INVALID", "message": "digest did not match"}]}`, http.StatusBadRequest)
+				return
+			}
+			f.blobs[digest] = f.uploads[name]
+			f.uploaded = append(f.uploaded, digest)
+			delete(f.uploads, name)
+			w.WriteHeader(http.StatusCreated)
+		}
+	case strings.HasPrefix(path, "/v2/app/blobs/"):
+		content, ok := f.blobs[name]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+		if r.Method == "GET" {
+			w.Write(content)
+		}
+	case strings.HasPrefix(path, "/v2/app/manifests/"):
+		if r.Method == "PUT" {
+			raw, _ := ioutil.ReadAll(r.Body)
+			if f.rewriteManifest != nil {
+				raw = f.rewriteManifest(raw)
+			}
+			f.addManifest(name, r.Header.Get("Content-Type"), raw)
+			w.Header().Set("Docker-Content-Digest", manifestDigest(raw))
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+
+		raw, ok := f.manifests[name]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", f.types[name])
+		w.Write(raw)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// Starts a fake registry and returns a client for it along with its host.
+func startFakeRegistry(t *testing.T, registry *fakeRegistry) (*RegistryClient, string, func()) {
+	srv := httptest.NewTLSServer(registry)
+	host := strings.TrimPrefix(srv.URL, "https://")
+
+	client := NewRegistryClient(host, RegistryAuth{})
+	client.client = srv.Client()
+
+	return client, host, srv.Close
+}
+
+func testManifest(config Descriptor, layers ...Descriptor) []byte {
+	var parts []string
+	for _, layer := range layers {
+		parts = append(parts, fmt.Sprintf(`{"mediaType": "application/vnd.docker.image.rootfs.diff.tar.gzip", "size": %d, "digest": "%s"}`, layer.Size, layer.Digest))
+	}
+
+	return []byte(fmt.Sprintf(`{"schemaVersion": 2, "mediaType": "%s", "config": {"mediaType": "application/vnd.docker.container.image.v1+json", "size": %d, "digest": "%s"}, "layers": [%s]}`,
+		MediaTypeManifestV2, config.Size, config.Digest, strings.Join(parts, ", ")))
+}
+
+func TestCopyImage(t *testing.T) {
+	src, dst := newFakeRegistry(), newFakeRegistry()
+
+	config := src.addBlob([]byte(`{"config": {"Labels": {"com.katch.git.sha": "abc"}}}`))
+	shared := src.addBlob([]byte("shared layer"))
+	layer := src.addBlob([]byte("new layer"))
+	dst.addBlob([]byte("shared layer"))
+
+	manifest := testManifest(config, shared, layer)
+	src.addManifest("2401020304", MediaTypeManifestV2, manifest)
+
+	srcClient, srcHost, closeSrc := startFakeRegistry(t, src)
+	defer closeSrc()
+	dstClient, dstHost, closeDst := startFakeRegistry(t, dst)
+	defer closeDst()
+
+	var out bytes.Buffer
+	digest, err := CopyImage(srcClient, dstClient, srcHost+"/app:2401020304", dstHost+"/app:prod-deploy-2401020304", &out)
+	if err != nil {
+		t.Fatalf("CopyImage returned an error: %s", err)
+	}
+
+	if digest != manifestDigest(manifest) {
+		t.Errorf("CopyImage = %s, want %s", digest, manifestDigest(manifest))
+	}
+	if !bytes.Equal(dst.manifests["prod-deploy-2401020304"], manifest) {
+		t.Errorf("Copied manifest = %s, want %s", dst.manifests["prod-deploy-2401020304"], manifest)
+	}
+	if dst.types["prod-deploy-2401020304"] != MediaTypeManifestV2 {
+		t.Errorf("Copied manifest has media type %s, want %s", dst.types["prod-deploy-2401020304"], MediaTypeManifestV2)
+	}
+
+	// The shared layer was already in the destination
+	if len(dst.uploaded) != 2 || dst.uploaded[0] != config.Digest || dst.uploaded[1] != layer.Digest {
+		t.Errorf("Uploaded blobs %v, want the config and the new layer", dst.uploaded)
+	}
+	if !strings.Contains(out.String(), shortDigest(shared.Digest)+": already exists") {
+		t.Errorf("Output doesn't say the shared layer was skipped:\n%s", out.String())
+	}
+
+	// Copying again uploads nothing
+	dst.uploaded = nil
+	if _, err := CopyImage(srcClient, dstClient, srcHost+"/app:2401020304", dstHost+"/app:prod-deploy-2401020304", ioutil.Discard); err != nil {
+		t.Fatalf("Second CopyImage returned an error: %s", err)
+	}
+	if len(dst.uploaded) != 0 {
+		t.Errorf("Second copy uploaded %v, want nothing", dst.uploaded)
+	}
+}
+
+func TestCopyImageManifestList(t *testing.T) {
+	src, dst := newFakeRegistry(), newFakeRegistry()
+
+	amd64 := testManifest(src.addBlob([]byte("amd64 config")), src.addBlob([]byte("amd64 layer")))
+	arm64 := testManifest(src.addBlob([]byte("arm64 config")), src.addBlob([]byte("arm64 layer")))
+	src.addManifest(manifestDigest(amd64), MediaTypeManifestV2, amd64)
+	src.addManifest(manifestDigest(arm64), MediaTypeManifestV2, arm64)
+
+	list := []byte(fmt.Sprintf(`{"schemaVersion": 2, "mediaType": "%s", "manifests": [{"mediaType": "%s", "size": %d, "digest": "%s", "platform": {"architecture": "amd64", "os": "linux"}}, {"mediaType": "%s", "size": %d, "digest": "%s", "platform": {"architecture": "arm64", "os": "linux"}}]}`,
+		MediaTypeManifestList, MediaTypeManifestV2, len(amd64), manifestDigest(amd64), MediaTypeManifestV2, len(arm64), manifestDigest(arm64)))
+	src.addManifest("multi", MediaTypeManifestList, list)
+
+	srcClient, srcHost, closeSrc := startFakeRegistry(t, src)
+	defer closeSrc()
+	dstClient, dstHost, closeDst := startFakeRegistry(t, dst)
+	defer closeDst()
+
+	digest, err := CopyImage(srcClient, dstClient, srcHost+"/app:multi", dstHost+"/app:multi", ioutil.Discard)
+	if err != nil {
+		t.Fatalf("CopyImage returned an error: %s", err)
+	}
+	if digest != manifestDigest(list) {
+		t.Errorf("CopyImage = %s, want %s", digest, manifestDigest(list))
+	}
+
+	for _, manifest := range [][]byte{amd64, arm64} {
+		if !bytes.Equal(dst.manifests[manifestDigest(manifest)], manifest) {
+			t.Errorf("Image %s from the list wasn't copied", manifestDigest(manifest))
+		}
+	}
+	if len(dst.uploaded) != 4 {
+		t.Errorf("Uploaded %d blobs, want 4", len(dst.uploaded))
+	}
+}
+
+func TestCopyImageVerifiesDigests(t *testing.T) {
+	src, dst := newFakeRegistry(), newFakeRegistry()
+
+	manifest := testManifest(src.addBlob([]byte("config")), src.addBlob([]byte("layer")))
+	src.addManifest("2401020304", MediaTypeManifestV2, manifest)
+
+	// A source that serves the wrong manifest for a digest
+	wrongDigest := manifestDigest([]byte("something else"))
+	src.addManifest(wrongDigest, MediaTypeManifestV2, manifest)
+
+	srcClient, srcHost, closeSrc := startFakeRegistry(t, src)
+	defer closeSrc()
+	dstClient, dstHost, closeDst := startFakeRegistry(t, dst)
+	defer closeDst()
+
+	_, err := CopyImage(srcClient, dstClient, srcHost+"/app@"+wrongDigest, dstHost+"/app:copy", ioutil.Discard)
+	if err == nil || !strings.Contains(err.Error(), "has digest") {
+		t.Errorf("CopyImage of a manifest with the wrong digest = %v, want a digest error", err)
+	}
+
+	// A destination that changes the manifest as it's stored
+	dst.rewriteManifest = func(raw []byte) []byte {
+		return append(raw, '\n')
+	}
+	_, err = CopyImage(srcClient, dstClient, srcHost+"/app:2401020304", dstHost+"/app:copy", ioutil.Discard)
+	if err == nil || !strings.Contains(err.Error(), "Copied manifest") {
+		t.Errorf("CopyImage to a registry that changes the manifest = %v, want a digest error", err)
+	}
+}
+
+func TestPutBlob(t *testing.T) {
+	registry := newFakeRegistry()
+	client, _, closeRegistry := startFakeRegistry(t, registry)
+	defer closeRegistry()
+
+	content := []byte("layer content")
+	digest := manifestDigest(content)
+
+	exists, err := client.BlobExists("app", digest)
+	if err != nil || exists {
+		t.Fatalf("BlobExists before the upload = %t, %v, want false", exists, err)
+	}
+
+	// The content is streamed, so the push token has to come from starting
+	// the upload
+	if err := client.PutBlob("app", digest, int64(len(content)), ioutil.NopCloser(bytes.NewReader(content))); err != nil {
+		t.Fatalf("PutBlob returned an error: %s", err)
+	}
+	if !bytes.Equal(registry.blobs[digest], content) {
+		t.Errorf("Uploaded blob = %q, want %q", registry.blobs[digest], content)
+	}
+
+	exists, err = client.BlobExists("app", digest)
+	if err != nil || !exists {
+		t.Errorf("BlobExists after the upload = %t, %v, want true", exists, err)
+	}
+
+	err = client.PutBlob("app", manifestDigest([]byte("other")), int64(len(content)), bytes.NewReader(content))
+	if err == nil {
+		t.Error("PutBlob with the wrong digest should return an error")
+	}
+}
+
+func TestFetchToken(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		query map[string]string
+	)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		query = map[string]string{"service": r.URL.Query().Get("service"), "scope": r.URL.Query().Get("scope"), "account": r.URL.Query().Get("account")}
+		fmt.Fprint(w, `{"access_token": "access"}`)
+	}))
+	defer srv.Close()
+
+	client := NewRegistryClient(strings.TrimPrefix(srv.URL, "https://"), RegistryAuth{})
+	client.client = srv.Client()
+
+	tests := []struct {
+		challenge string
+		service   string
+		scope     string
+		account   string
+		wantErr   bool
+	}{
+		{
+			challenge: fmt.Sprintf(`Bearer realm="%s/token",service="registry.example.com",scope="repository:app:pull"`, srv.URL),
+			service:   "registry.example.com",
+			scope:     "repository:app:pull",
+		},
+		{
+			challenge: fmt.Sprintf(`Bearer realm="%s/token",service="registry.example.com",scope="repository:app:pull,push"`, srv.URL),
+			service:   "registry.example.com",
+			scope:     "repository:app:pull,push",
+		},
+		{
+			challenge: fmt.Sprintf(`Bearer scope="repository:team/app:pull,push", realm="%s/token", service=registry`, srv.URL),
+			service:   "registry",
+			scope:     "repository:team/app:pull,push",
+		},
+		{
+			challenge: fmt.Sprintf(`Bearer realm="%s/token?account=ci"`, srv.URL),
+			account:   "ci",
+		},
+		{challenge: `Bearer service="registry.example.com",scope="repository:app:pull"`, wantErr: true},
+		{challenge: `Bearer realm=""`, wantErr: true},
+	}
+
+	for _, test := range tests {
+		query = nil
+		token, err := client.fetchToken(test.challenge)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("fetchToken(%s) = %s, want an error", test.challenge, token)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("fetchToken(%s) returned an error: %s", test.challenge, err)
+			continue
+		}
+		if token != "access" {
+			t.Errorf("fetchToken(%s) = %s, want access", test.challenge, token)
+		}
+		if query["service"] != test.service || query["scope"] != test.scope || query["account"] != test.account {
+			t.Errorf("fetchToken(%s) asked for %v, want service %q, scope %q and account %q", test.challenge, query, test.service, test.scope, test.account)
+		}
+	}
+}
@@ -0,0 +1,537 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const (
+	LockBackendFile     = "file"
+	LockBackendDynamoDB = "dynamodb"
+
+	DefaultLockTTL = 10 * time.Minute
+	lockDirName    = ".build_tool/locks"
+
+	// Changes to a file lock take milliseconds, so a guard held this long was
+	// left behind
+	lockGuardTimeout = 30 * time.Second
+	lockGuardSleep   = 10 * time.Millisecond
+)
+
+// A named lock along with who holds it.
+type Lock struct {
+	Name       string    `json:"name"`
+	Owner      string    `json:"owner"`
+	Info       string    `json:"info,omitempty"`
+	AcquiredAt time.Time `json:"acquired_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// Returns true once the lock's TTL has passed. Expired locks can be taken
+// over by anyone.
+func (l *Lock) Expired() bool {
+	return time.Now().After(l.ExpiresAt)
+}
+
+// Error returned when a lock is held by someone else.
+type LockHeldError struct {
+	Lock *Lock
+}
+
+func (e *LockHeldError) Error() string {
+	return fmt.Sprintf("%s is locked by %s since %s until %s (%s)",
+		e.Lock.Name,
+		e.Lock.Owner,
+		e.Lock.AcquiredAt.Local().Format(time.RFC3339),
+		e.Lock.ExpiresAt.Local().Format(time.RFC3339),
+		e.Lock.Info,
+	)
+}
+
+// Storage for named locks. Implementations must make Acquire atomic so only
+// one caller can hold a lock at a time.
+type Locker interface {
+	// Takes the lock unless someone else holds an unexpired lock with the same
+	// name, in which case a *LockHeldError is returned.
+	Acquire(lock Lock) error
+	// Moves the lock's expiry to lock.ExpiresAt if it is still held by
+	// lock.Owner.
+	Renew(lock Lock) error
+	// Releases the lock if it is still held by owner.
+	Release(name, owner string) error
+	// Returns the current holder of the lock, or nil if it isn't held.
+	Get(name string) (*Lock, error)
+	// Removes the lock no matter who holds it.
+	Break(name string) error
+}
+
+// Creates a new lock owned by the current user and process.
+//
+// name -- Name of the lock
+// info -- Describes what the lock is held for
+// ttl -- How long the lock is held before it expires
+func NewLock(name, info string, ttl time.Duration) Lock {
+	if ttl <= 0 {
+		ttl = DefaultLockTTL
+	}
+
+	now := time.Now()
+	return Lock{
+		Name:       name,
+		Owner:      LockOwner(),
+		Info:       info,
+		AcquiredAt: now,
+		ExpiresAt:  now.Add(ttl),
+	}
+}
+
+// Identifies the current process as <user>@<host>:<pid>.
+func LockOwner() string {
+	name := os.Getenv("USER")
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+
+	return fmt.Sprintf("%s@%s:%d", name, host, os.Getpid())
+}
+
+// Renews a lock every third of its TTL so it doesn't expire while it's held
+// for longer than the TTL. Returns a function that stops renewing it. Failed
+// renewals are reported but don't stop the renewals.
+//
+// locker -- Backend the lock was taken from
+// lock -- Lock to keep
+func KeepLock(locker Locker, lock Lock) func() {
+	ttl := lock.ExpiresAt.Sub(lock.AcquiredAt)
+	ticker := time.NewTicker(ttl / 3)
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				lock.ExpiresAt = now.Add(ttl)
+				if err := locker.Renew(lock); err != nil {
+					fmt.Fprintf(os.Stderr, "Unable to renew lock %s: %s\n", lock.Name, err)
+				}
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			ticker.Stop()
+			close(done)
+		})
+	}
+}
+
+// Creates the lock backend from the config. Locks are kept in DynamoDB when a
+// table is set and in files otherwise.
+//
+// config -- Lock settings from the config file
+// sess -- AWS session used by backends that store locks in AWS
+func NewLocker(config LockConfig, sess *session.Session) (Locker, error) {
+	backend := config.Backend
+	if backend == "" {
+		backend = LockBackendFile
+		if config.Table != "" {
+			backend = LockBackendDynamoDB
+		}
+	}
+
+	switch backend {
+	case LockBackendFile:
+		dir := config.Dir
+		if dir == "" {
+			home, err := homeDir()
+			if err != nil {
+				return nil, err
+			}
+			dir = filepath.Join(home, lockDirName)
+		}
+		return &FileLocker{Dir: dir}, nil
+	case LockBackendDynamoDB:
+		if config.Table == "" {
+			return nil, fmt.Errorf("A table is needed for the %s lock backend", LockBackendDynamoDB)
+		}
+		return &DynamoDBLocker{Table: config.Table, Client: dynamodb.New(sess)}, nil
+	}
+
+	return nil, fmt.Errorf("Unknown lock backend %s", config.Backend)
+}
+
+// Keeps locks as files in a directory. Only processes sharing the directory
+// are kept apart, so deploys from different CI hosts or laptops don't see
+// each other's locks. Use the DynamoDB backend when deploys can run on more
+// than one host.
+type FileLocker struct {
+	Dir string
+}
+
+func (l *FileLocker) file(name string) string {
+	return filepath.Join(l.Dir, cacheNameRegex.ReplaceAllString(name, "_")+".lock")
+}
+
+// Writes a lock to a temporary file in the lock directory so it can be put in
+// place in one step. Returns the name of the file.
+func (l *FileLocker) writeTemp(lock Lock) (string, error) {
+	data, err := json.Marshal(lock)
+	if err != nil {
+		return "", err
+	}
+
+	tmp, err := ioutil.TempFile(l.Dir, ".lock")
+	if err != nil {
+		return "", err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+
+	return tmp.Name(), nil
+}
+
+// Runs a change to an existing lock file while holding the lock's guard file.
+// Creating a missing lock is atomic by itself, but replacing or removing one
+// isn't: two processes taking over the same expired lock would each replace
+// it and both think they held it. Waits for a guard held by another process,
+// and gives up if it's held for so long the process holding it must have
+// died.
+func (l *FileLocker) guarded(name string, change func() error) error {
+	guard := l.file(name) + ".guard"
+	start := time.Now()
+
+	for {
+		f, err := os.OpenFile(guard, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			f.Close()
+			break
+		} else if !os.IsExist(err) {
+			return err
+		}
+
+		if time.Since(start) > lockGuardTimeout {
+			return fmt.Errorf("Lock %s is stuck being changed by another process, break it to continue", name)
+		}
+		time.Sleep(lockGuardSleep)
+	}
+	defer os.Remove(guard)
+
+	return change()
+}
+
+func (l *FileLocker) Acquire(lock Lock) error {
+	if err := os.MkdirAll(l.Dir, 0700); err != nil {
+		return err
+	}
+
+	// The lock is written out in full before it's put in place so it's never
+	// seen half written
+	tmp, err := l.writeTemp(lock)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	file := l.file(lock.Name)
+	for attempt := 0; attempt < 2; attempt++ {
+		// Linking fails when the lock exists, which makes it the atomic step
+		err := os.Link(tmp, file)
+		if err == nil {
+			return nil
+		} else if !os.IsExist(err) {
+			return err
+		}
+
+		// An expired lock is only replaced by whoever holds the guard, after
+		// checking it's still expired. Anyone else then sees the new lock.
+		var taken bool
+		err = l.guarded(lock.Name, func() error {
+			held, err := l.Get(lock.Name)
+			if err != nil || held == nil {
+				return err
+			}
+			if !held.Expired() {
+				return &LockHeldError{Lock: held}
+			}
+
+			if err := os.Rename(tmp, file); err != nil {
+				return err
+			}
+			taken = true
+			return nil
+		})
+		if err != nil || taken {
+			return err
+		}
+	}
+
+	return fmt.Errorf("Unable to take lock %s", lock.Name)
+}
+
+func (l *FileLocker) Renew(lock Lock) error {
+	return l.guarded(lock.Name, func() error {
+		held, err := l.Get(lock.Name)
+		if err != nil {
+			return err
+		}
+		if held == nil || held.Owner != lock.Owner {
+			return fmt.Errorf("Lock %s is no longer held by %s", lock.Name, lock.Owner)
+		}
+
+		// The lock is replaced in one step so it's never missing or half
+		// written
+		tmp, err := l.writeTemp(lock)
+		if err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, l.file(lock.Name)); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+		return nil
+	})
+}
+
+func (l *FileLocker) Release(name, owner string) error {
+	return l.guarded(name, func() error {
+		held, err := l.Get(name)
+		if err != nil || held == nil {
+			return err
+		}
+
+		if held.Owner != owner {
+			return &LockHeldError{Lock: held}
+		}
+
+		return removeIfExists(l.file(name))
+	})
+}
+
+func (l *FileLocker) Get(name string) (*Lock, error) {
+	data, err := ioutil.ReadFile(l.file(name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var lock Lock
+	if err := json.Unmarshal(data, &lock); err != nil {
+		return nil, fmt.Errorf("Unable to read lock %s: %s", name, err)
+	}
+
+	return &lock, nil
+}
+
+// Removes the lock along with a guard left behind by a process that died
+// while changing it.
+func (l *FileLocker) Break(name string) error {
+	if err := removeIfExists(l.file(name) + ".guard"); err != nil {
+		return err
+	}
+	return removeIfExists(l.file(name))
+}
+
+func removeIfExists(file string) error {
+	err := os.Remove(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Keeps locks in a DynamoDB table with a string hash key named "name".
+// Conditional writes make taking a lock atomic across hosts.
+type DynamoDBLocker struct {
+	Table  string
+	Client *dynamodb.DynamoDB
+}
+
+func (l *DynamoDBLocker) Acquire(lock Lock) error {
+	item := map[string]*dynamodb.AttributeValue{
+		"name":        {S: aws.String(lock.Name)},
+		"owner":       {S: aws.String(lock.Owner)},
+		"acquired_at": {N: aws.String(strconv.FormatInt(lock.AcquiredAt.Unix(), 10))},
+		"expires_at":  {N: aws.String(strconv.FormatInt(lock.ExpiresAt.Unix(), 10))},
+	}
+
+	// DynamoDB doesn't allow empty strings
+	if lock.Info != "" {
+		item["info"] = &dynamodb.AttributeValue{S: aws.String(lock.Info)}
+	}
+
+	_, err := l.Client.PutItem(&dynamodb.PutItemInput{
+		TableName:           aws.String(l.Table),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(#name) OR expires_at < :now"),
+		ExpressionAttributeNames: map[string]*string{
+			"#name": aws.String("name"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":now": {N: aws.String(strconv.FormatInt(time.Now().Unix(), 10))},
+		},
+	})
+	if isConditionalCheckFailed(err) {
+		held, err := l.Get(lock.Name)
+		if err != nil {
+			return err
+		}
+		if held == nil {
+			return fmt.Errorf("Lock %s was released while taking it, try again", lock.Name)
+		}
+		return &LockHeldError{Lock: held}
+	} else if err != nil {
+		return fmt.Errorf("Unable to take lock %s: %s", lock.Name, err)
+	}
+
+	return nil
+}
+
+func (l *DynamoDBLocker) Renew(lock Lock) error {
+	_, err := l.Client.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:           aws.String(l.Table),
+		Key:                 lockKey(lock.Name),
+		UpdateExpression:    aws.String("SET expires_at = :expires"),
+		ConditionExpression: aws.String("#owner = :owner"),
+		ExpressionAttributeNames: map[string]*string{
+			"#owner": aws.String("owner"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":owner":   {S: aws.String(lock.Owner)},
+			":expires": {N: aws.String(strconv.FormatInt(lock.ExpiresAt.Unix(), 10))},
+		},
+	})
+	if isConditionalCheckFailed(err) {
+		return fmt.Errorf("Lock %s is no longer held by %s", lock.Name, lock.Owner)
+	} else if err != nil {
+		return fmt.Errorf("Unable to renew lock %s: %s", lock.Name, err)
+	}
+
+	return nil
+}
+
+func (l *DynamoDBLocker) Release(name, owner string) error {
+	_, err := l.Client.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName:           aws.String(l.Table),
+		Key:                 lockKey(name),
+		ConditionExpression: aws.String("attribute_not_exists(#name) OR #owner = :owner"),
+		ExpressionAttributeNames: map[string]*string{
+			"#name":  aws.String("name"),
+			"#owner": aws.String("owner"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":owner": {S: aws.String(owner)},
+		},
+	})
+	if isConditionalCheckFailed(err) {
+		held, err := l.Get(name)
+		if err != nil || held == nil {
+			return err
+		}
+		return &LockHeldError{Lock: held}
+	} else if err != nil {
+		return fmt.Errorf("Unable to release lock %s: %s", name, err)
+	}
+
+	return nil
+}
+
+func (l *DynamoDBLocker) Get(name string) (*Lock, error) {
+	resp, err := l.Client.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(l.Table),
+		Key:            lockKey(name),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to look up lock %s: %s", name, err)
+	}
+
+	if len(resp.Item) == 0 {
+		return nil, nil
+	}
+
+	lock := &Lock{
+		Name:  name,
+		Owner: attributeString(resp.Item["owner"]),
+		Info:  attributeString(resp.Item["info"]),
+	}
+
+	if lock.AcquiredAt, err = attributeTime(resp.Item["acquired_at"]); err != nil {
+		return nil, fmt.Errorf("Unable to read lock %s: %s", name, err)
+	}
+	if lock.ExpiresAt, err = attributeTime(resp.Item["expires_at"]); err != nil {
+		return nil, fmt.Errorf("Unable to read lock %s: %s", name, err)
+	}
+
+	return lock, nil
+}
+
+func (l *DynamoDBLocker) Break(name string) error {
+	_, err := l.Client.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName: aws.String(l.Table),
+		Key:       lockKey(name),
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to break lock %s: %s", name, err)
+	}
+
+	return nil
+}
+
+func lockKey(name string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"name": {S: aws.String(name)},
+	}
+}
+
+func isConditionalCheckFailed(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == "ConditionalCheckFailedException"
+}
+
+func attributeString(v *dynamodb.AttributeValue) string {
+	if v == nil {
+		return ""
+	}
+	return aws.StringValue(v.S)
+}
+
+func attributeTime(v *dynamodb.AttributeValue) (time.Time, error) {
+	if v == nil || v.N == nil {
+		return time.Time{}, nil
+	}
+
+	seconds, err := strconv.ParseInt(aws.StringValue(v.N), 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return time.Unix(seconds, 0), nil
+}
@@ -0,0 +1,291 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestFileLocker(t *testing.T) (*FileLocker, func()) {
+	dir, err := ioutil.TempDir("", "locks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &FileLocker{Dir: dir}, func() { os.RemoveAll(dir) }
+}
+
+func testLock(owner string, ttl time.Duration) Lock {
+	now := time.Now()
+	return Lock{
+		Name:       "app-stage",
+		Owner:      owner,
+		Info:       "deploying",
+		AcquiredAt: now,
+		ExpiresAt:  now.Add(ttl),
+	}
+}
+
+func TestFileLockerAcquire(t *testing.T) {
+	locker, cleanup := newTestFileLocker(t)
+	defer cleanup()
+
+	lock := testLock("alice", time.Hour)
+	if err := locker.Acquire(lock); err != nil {
+		t.Fatalf("Acquire returned an error: %s", err)
+	}
+
+	held, err := locker.Get(lock.Name)
+	if err != nil {
+		t.Fatalf("Get returned an error: %s", err)
+	}
+	if held == nil || held.Owner != "alice" || held.Info != "deploying" {
+		t.Errorf("Get = %+v, want the lock held by alice", held)
+	}
+}
+
+func TestFileLockerContention(t *testing.T) {
+	locker, cleanup := newTestFileLocker(t)
+	defer cleanup()
+
+	if err := locker.Acquire(testLock("alice", time.Hour)); err != nil {
+		t.Fatalf("Acquire returned an error: %s", err)
+	}
+
+	err := locker.Acquire(testLock("bob", time.Hour))
+	heldErr, ok := err.(*LockHeldError)
+	if !ok {
+		t.Fatalf("Acquire by another owner = %v, want a *LockHeldError", err)
+	}
+	if heldErr.Lock.Owner != "alice" {
+		t.Errorf("LockHeldError owner = %s, want alice", heldErr.Lock.Owner)
+	}
+}
+
+func TestFileLockerExpiry(t *testing.T) {
+	locker, cleanup := newTestFileLocker(t)
+	defer cleanup()
+
+	expired := testLock("alice", -time.Minute)
+	if err := locker.Acquire(expired); err != nil {
+		t.Fatalf("Acquire returned an error: %s", err)
+	}
+
+	if err := locker.Acquire(testLock("bob", time.Hour)); err != nil {
+		t.Fatalf("Acquire of an expired lock returned an error: %s", err)
+	}
+
+	held, err := locker.Get(expired.Name)
+	if err != nil {
+		t.Fatalf("Get returned an error: %s", err)
+	}
+	if held == nil || held.Owner != "bob" {
+		t.Errorf("Get = %+v, want the lock held by bob", held)
+	}
+}
+
+func TestFileLockerExpiryContention(t *testing.T) {
+	locker, cleanup := newTestFileLocker(t)
+	defer cleanup()
+
+	for round := 0; round < 20; round++ {
+		expired := testLock("alice", -time.Minute)
+		if err := locker.Break(expired.Name); err != nil {
+			t.Fatalf("Break returned an error: %s", err)
+		}
+		if err := locker.Acquire(expired); err != nil {
+			t.Fatalf("Acquire returned an error: %s", err)
+		}
+
+		// Everyone sees the expired lock and tries to take it over at once
+		var owners []string
+		for i := 0; i < 20; i++ {
+			owners = append(owners, fmt.Sprintf("owner-%d", i))
+		}
+		errs := make([]error, len(owners))
+		var wg sync.WaitGroup
+		for i, owner := range owners {
+			wg.Add(1)
+			go func(i int, owner string) {
+				defer wg.Done()
+				errs[i] = locker.Acquire(testLock(owner, time.Hour))
+			}(i, owner)
+		}
+		wg.Wait()
+
+		var winners []string
+		for i, err := range errs {
+			if err == nil {
+				winners = append(winners, owners[i])
+			} else if _, ok := err.(*LockHeldError); !ok {
+				t.Errorf("Acquire by %s = %v, want a *LockHeldError", owners[i], err)
+			}
+		}
+		if len(winners) != 1 {
+			t.Fatalf("Round %d: %v all acquired the lock, want exactly one", round, winners)
+		}
+
+		held, err := locker.Get(expired.Name)
+		if err != nil {
+			t.Fatalf("Get returned an error: %s", err)
+		}
+		if held == nil || held.Owner != winners[0] {
+			t.Fatalf("Round %d: Get = %+v, want the lock held by %s", round, held, winners[0])
+		}
+	}
+}
+
+func TestFileLockerRelease(t *testing.T) {
+	locker, cleanup := newTestFileLocker(t)
+	defer cleanup()
+
+	lock := testLock("alice", time.Hour)
+	if err := locker.Acquire(lock); err != nil {
+		t.Fatalf("Acquire returned an error: %s", err)
+	}
+
+	if _, ok := locker.Release(lock.Name, "bob").(*LockHeldError); !ok {
+		t.Errorf("Release by another owner should return a *LockHeldError")
+	}
+
+	if err := locker.Release(lock.Name, "alice"); err != nil {
+		t.Fatalf("Release returned an error: %s", err)
+	}
+
+	held, err := locker.Get(lock.Name)
+	if err != nil {
+		t.Fatalf("Get returned an error: %s", err)
+	}
+	if held != nil {
+		t.Errorf("Get = %+v after release, want nil", held)
+	}
+
+	// Releasing a lock nobody holds is fine
+	if err := locker.Release(lock.Name, "alice"); err != nil {
+		t.Errorf("Release of a free lock returned an error: %s", err)
+	}
+
+	if err := locker.Acquire(testLock("bob", time.Hour)); err != nil {
+		t.Errorf("Acquire after release returned an error: %s", err)
+	}
+}
+
+func TestFileLockerRenew(t *testing.T) {
+	locker, cleanup := newTestFileLocker(t)
+	defer cleanup()
+
+	lock := testLock("alice", time.Minute)
+	if err := locker.Acquire(lock); err != nil {
+		t.Fatalf("Acquire returned an error: %s", err)
+	}
+
+	lock.ExpiresAt = lock.ExpiresAt.Add(time.Hour)
+	if err := locker.Renew(lock); err != nil {
+		t.Fatalf("Renew returned an error: %s", err)
+	}
+
+	held, err := locker.Get(lock.Name)
+	if err != nil {
+		t.Fatalf("Get returned an error: %s", err)
+	}
+	if held == nil || !held.ExpiresAt.Equal(lock.ExpiresAt) {
+		t.Errorf("Get = %+v, want it to expire at %s", held, lock.ExpiresAt)
+	}
+
+	other := testLock("bob", time.Hour)
+	if err := locker.Renew(other); err == nil {
+		t.Errorf("Renew by another owner should return an error")
+	}
+}
+
+func TestFileLockerTakeoverRace(t *testing.T) {
+	locker, cleanup := newTestFileLocker(t)
+	defer cleanup()
+
+	expired := testLock("alice", -time.Minute)
+	if err := locker.Acquire(expired); err != nil {
+		t.Fatalf("Acquire returned an error: %s", err)
+	}
+
+	// Bob is taking the expired lock over when carol finds it expired too
+	guard := locker.file(expired.Name) + ".guard"
+	if err := ioutil.WriteFile(guard, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- locker.Acquire(testLock("carol", time.Hour))
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	data, err := json.Marshal(testLock("bob", time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(locker.file(expired.Name), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(guard)
+
+	err = <-done
+	if heldErr, ok := err.(*LockHeldError); !ok || heldErr.Lock.Owner != "bob" {
+		t.Errorf("Acquire by carol = %v, want the lock held by bob", err)
+	}
+
+	held, err := locker.Get(expired.Name)
+	if err != nil {
+		t.Fatalf("Get returned an error: %s", err)
+	}
+	if held == nil || held.Owner != "bob" {
+		t.Errorf("Get = %+v, want the lock held by bob", held)
+	}
+}
+
+func TestFileLockerStuckGuard(t *testing.T) {
+	locker, cleanup := newTestFileLocker(t)
+	defer cleanup()
+
+	lock := testLock("alice", -time.Minute)
+	if err := locker.Acquire(lock); err != nil {
+		t.Fatalf("Acquire returned an error: %s", err)
+	}
+
+	// A guard left by a process that died while taking the lock over
+	if err := ioutil.WriteFile(locker.file(lock.Name)+".guard", nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := locker.Break(lock.Name); err != nil {
+		t.Fatalf("Break returned an error: %s", err)
+	}
+	if err := locker.Acquire(testLock("bob", time.Hour)); err != nil {
+		t.Errorf("Acquire after breaking a stuck lock returned an error: %s", err)
+	}
+}
+
+func TestKeepLock(t *testing.T) {
+	locker, cleanup := newTestFileLocker(t)
+	defer cleanup()
+
+	lock := testLock("alice", 300*time.Millisecond)
+	if err := locker.Acquire(lock); err != nil {
+		t.Fatalf("Acquire returned an error: %s", err)
+	}
+
+	stop := KeepLock(locker, lock)
+	time.Sleep(500 * time.Millisecond)
+	stop()
+
+	if err := locker.Acquire(testLock("bob", time.Hour)); err == nil {
+		t.Fatalf("Acquire of a renewed lock should fail")
+	}
+
+	time.Sleep(400 * time.Millisecond)
+	if err := locker.Acquire(testLock("bob", time.Hour)); err != nil {
+		t.Errorf("Acquire after renewals stopped returned an error: %s", err)
+	}
+}
@@ -0,0 +1,159 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/secretsmanager"
+	"github.com/aws/aws-sdk-go/service/ssm"
+)
+
+const (
+	ParamRefSSM            = "ssm:"
+	ParamRefSecretsManager = "secretsmanager:"
+	ParamRefEnv            = "env:"
+	ParamRefFile           = "file:"
+)
+
+// Looks up a parameter from the SSM Parameter Store.
+type ParameterStore interface {
+	GetParameter(name string) (string, error)
+}
+
+// Looks up a secret from AWS Secrets Manager.
+type SecretStore interface {
+	GetSecretValue(secretId string) (string, error)
+}
+
+// Resolves references in Cloudformation parameter values to the value they
+// point at. Supported references are:
+//
+// ssm:/path -- Decrypted value of an SSM parameter
+// secretsmanager:<arn or name>#field -- Secret string, or a field of a JSON secret
+// env:VAR -- Value of an environment variable
+// file:path -- Contents of a file
+//
+// Values without a reference prefix are used as they are.
+type ParameterResolver struct {
+	Parameters ParameterStore
+	Secrets    SecretStore
+}
+
+// Creates a resolver that looks up SSM parameters and secrets with the given
+// session.
+func NewParameterResolver(sess *session.Session) *ParameterResolver {
+	return &ParameterResolver{
+		Parameters: ssmClient{ssm.New(sess)},
+		Secrets:    secretsManagerClient{secretsmanager.New(sess)},
+	}
+}
+
+// Resolves a parameter value. The returned bool is true when the value came
+// from a reference and may be sensitive, so it must not be logged.
+func (r *ParameterResolver) Resolve(value string) (string, bool, error) {
+	switch {
+	case strings.HasPrefix(value, ParamRefSSM):
+		name := strings.TrimPrefix(value, ParamRefSSM)
+		resolved, err := r.Parameters.GetParameter(name)
+		if err != nil {
+			return "", true, fmt.Errorf("Unable to get SSM parameter %s: %s", name, err)
+		}
+		return resolved, true, nil
+	case strings.HasPrefix(value, ParamRefSecretsManager):
+		resolved, err := r.resolveSecret(strings.TrimPrefix(value, ParamRefSecretsManager))
+		return resolved, true, err
+	case strings.HasPrefix(value, ParamRefEnv):
+		name := strings.TrimPrefix(value, ParamRefEnv)
+		resolved, ok := os.LookupEnv(name)
+		if !ok {
+			return "", true, fmt.Errorf("Environment variable %s is not set", name)
+		}
+		return resolved, true, nil
+	case strings.HasPrefix(value, ParamRefFile):
+		path := strings.TrimPrefix(value, ParamRefFile)
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", true, fmt.Errorf("Unable to read %s: %s", path, err)
+		}
+		return strings.TrimRight(string(contents), "\r\n"), true, nil
+	}
+
+	return value, false, nil
+}
+
+func (r *ParameterResolver) resolveSecret(ref string) (string, error) {
+	var fields map[string]interface{}
+
+	secretId, field := ref, ""
+	if i := strings.LastIndex(ref, "#"); i >= 0 {
+		secretId, field = ref[:i], ref[i+1:]
+	}
+
+	secret, err := r.Secrets.GetSecretValue(secretId)
+	if err != nil {
+		return "", fmt.Errorf("Unable to get secret %s: %s", secretId, err)
+	}
+
+	if field == "" {
+		return secret, nil
+	}
+
+	if err := json.Unmarshal([]byte(secret), &fields); err != nil {
+		return "", fmt.Errorf("Secret %s is not a JSON object so field %s can't be read", secretId, field)
+	}
+
+	value, ok := fields[field]
+	if !ok {
+		return "", fmt.Errorf("Secret %s has no field %s", secretId, field)
+	}
+
+	if s, ok := value.(string); ok {
+		return s, nil
+	}
+
+	return fmt.Sprint(value), nil
+}
+
+type ssmClient struct {
+	*ssm.SSM
+}
+
+func (c ssmClient) GetParameter(name string) (string, error) {
+	resp, err := c.SSM.GetParameter(&ssm.GetParameterInput{
+		Name:           aws.String(name),
+		WithDecryption: aws.Bool(true),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if resp.Parameter == nil {
+		return "", fmt.Errorf("Parameter %s has no value", name)
+	}
+
+	return aws.StringValue(resp.Parameter.Value), nil
+}
+
+type secretsManagerClient struct {
+	*secretsmanager.SecretsManager
+}
+
+func (c secretsManagerClient) GetSecretValue(secretId string) (string, error) {
+	resp, err := c.SecretsManager.GetSecretValue(&secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(secretId),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if resp.SecretString == nil {
+		return "", fmt.Errorf("Secret %s has no string value", secretId)
+	}
+
+	return aws.StringValue(resp.SecretString), nil
+}
@@ -0,0 +1,92 @@
+package utils
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type fakeParameterStore map[string]string
+
+func (f fakeParameterStore) GetParameter(name string) (string, error) {
+	value, ok := f[name]
+	if !ok {
+		return "", errors.New("ParameterNotFound")
+	}
+	return value, nil
+}
+
+type fakeSecretStore map[string]string
+
+func (f fakeSecretStore) GetSecretValue(secretId string) (string, error) {
+	value, ok := f[secretId]
+	if !ok {
+		return "", errors.New("ResourceNotFoundException")
+	}
+	return value, nil
+}
+
+func TestParameterResolverResolve(t *testing.T) {
+	dir, err := ioutil.TempDir("", "params")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "password")
+	if err := ioutil.WriteFile(file, []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("BUILD_TOOL_TEST_PARAM", "from-env")
+	defer os.Unsetenv("BUILD_TOOL_TEST_PARAM")
+
+	resolver := &ParameterResolver{
+		Parameters: fakeParameterStore{"/app/db/password": "from-ssm"},
+		Secrets: fakeSecretStore{
+			"app/plain": "from-secret",
+			"app/json":  `{"username": "app", "port": 5432}`,
+		},
+	}
+
+	tests := []struct {
+		value     string
+		want      string
+		sensitive bool
+		wantErr   bool
+	}{
+		{value: "plain", want: "plain"},
+		{value: "", want: ""},
+		{value: "ssm:/app/db/password", want: "from-ssm", sensitive: true},
+		{value: "ssm:/app/missing", sensitive: true, wantErr: true},
+		{value: "secretsmanager:app/plain", want: "from-secret", sensitive: true},
+		{value: "secretsmanager:app/json#username", want: "app", sensitive: true},
+		{value: "secretsmanager:app/json#port", want: "5432", sensitive: true},
+		{value: "secretsmanager:app/json#missing", sensitive: true, wantErr: true},
+		{value: "secretsmanager:app/plain#field", sensitive: true, wantErr: true},
+		{value: "secretsmanager:app/missing", sensitive: true, wantErr: true},
+		{value: "env:BUILD_TOOL_TEST_PARAM", want: "from-env", sensitive: true},
+		{value: "env:BUILD_TOOL_TEST_UNSET", sensitive: true, wantErr: true},
+		{value: "file:" + file, want: "from-file", sensitive: true},
+		{value: "file:" + filepath.Join(dir, "missing"), sensitive: true, wantErr: true},
+	}
+
+	for _, test := range tests {
+		got, sensitive, err := resolver.Resolve(test.value)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("Resolve(%q) = %q, want an error", test.value, got)
+			}
+		} else if err != nil {
+			t.Errorf("Resolve(%q) returned an error: %s", test.value, err)
+		} else if got != test.want {
+			t.Errorf("Resolve(%q) = %q, want %q", test.value, got, test.want)
+		}
+
+		if sensitive != test.sensitive {
+			t.Errorf("Resolve(%q) sensitive = %t, want %t", test.value, sensitive, test.sensitive)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package utils
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// The images an environment deploys: the latest tag of a kind from the source
+// environment that has had its tag for at least the soak time. When Registry
+// is set the images are copied to it before they are deployed.
+type PromotionRule struct {
+	Env      string
+	From     string
+	Kind     TagKind
+	Soak     time.Duration
+	Registry string
+}
+
+// Looks up the promotion rule for an environment. Environments without a
+// [promotion] section deploy the latest build, except prod which deploys the
+// latest image that passed in stage.
+//
+// env -- Environment to look up
+func (c Config) PromotionRule(env string) (PromotionRule, error) {
+	promotion, ok := c.Promotion[env]
+	if !ok {
+		if env == "prod" {
+			return PromotionRule{Env: env, From: "stage", Kind: TagKindPass}, nil
+		}
+		return PromotionRule{Env: env, Kind: TagKindBuild}, nil
+	}
+
+	rule := PromotionRule{
+		Env:      env,
+		From:     promotion.From,
+		Kind:     TagKind(promotion.Kind),
+		Soak:     promotion.Soak.Duration,
+		Registry: promotion.Registry,
+	}
+
+	if rule.Kind == "" {
+		rule.Kind = TagKindPass
+		if rule.From == "" {
+			rule.Kind = TagKindBuild
+		}
+	}
+
+	switch rule.Kind {
+	case TagKindBuild:
+		rule.From = ""
+	case TagKindPass, TagKindDeploy:
+		if rule.From == "" {
+			return PromotionRule{}, fmt.Errorf("Promotion for %s needs an environment to promote %s images from", env, rule.Kind)
+		}
+		if rule.From == env {
+			return PromotionRule{}, fmt.Errorf("Promotion for %s can't promote from itself", env)
+		}
+	default:
+		return PromotionRule{}, fmt.Errorf("Promotion for %s has an unknown kind %s, must be build, pass or deploy", env, rule.Kind)
+	}
+
+	return rule, nil
+}
+
+// Describes where the rule takes images from, e.g. "stage-pass".
+func (r PromotionRule) Source() string {
+	if r.Kind == TagKindBuild {
+		return "builds"
+	}
+	return fmt.Sprintf("%s-%s", r.From, r.Kind)
+}
+
+// Reports whether a tag is of the kind and environment the rule promotes,
+// ignoring the soak time.
+func (r PromotionRule) Matches(t Tag) bool {
+	return t.Kind == r.Kind && t.Env == r.From
+}
+
+// Reports whether a tag has soaked long enough to be promoted.
+//
+// t -- Tag to check
+// now -- Time to measure the soak up to
+func (r PromotionRule) Soaked(t Tag, now time.Time) bool {
+	return !t.Time.Add(r.Soak).After(now)
+}
+
+// Finds the tag of the latest image an environment can deploy under its
+// promotion rule.
+//
+// ecr -- Name of the AWS ECR to use
+// name -- Name of the repository in the ECR
+// rule -- Promotion rule of the environment being deployed to
+// sess -- AWS session to use
+func FindPromotionCandidate(ecrRepo, name string, rule PromotionRule, sess *session.Session) (string, error) {
+	matches, err := findTaggedImages(ecrRepo, name, rule.Matches, sess)
+	if err != nil {
+		return "", err
+	}
+
+	if len(matches) == 0 {
+		return "", fmt.Errorf("No %s images found to deploy to %s", rule.Source(), rule.Env)
+	}
+
+	// The matches are sorted so the latest soaked image is the last one
+	// that passes
+	now := time.Now()
+	for i := len(matches) - 1; i >= 0; i-- {
+		tag := aws.StringValue(matches[i].ImageTag)
+		t, err := ParseTag(tag)
+		if err == nil && rule.Soaked(t, now) {
+			return tag, nil
+		}
+	}
+
+	return "", fmt.Errorf("No %s images have soaked for %s yet", rule.Source(), rule.Soak)
+}
@@ -0,0 +1,191 @@
+package utils
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+func TestPromotionRuleDefaults(t *testing.T) {
+	var config Config
+
+	tests := []struct {
+		env  string
+		want PromotionRule
+	}{
+		{"prod", PromotionRule{Env: "prod", From: "stage", Kind: TagKindPass}},
+		{"stage", PromotionRule{Env: "stage", Kind: TagKindBuild}},
+		{"dev", PromotionRule{Env: "dev", Kind: TagKindBuild}},
+	}
+
+	for _, test := range tests {
+		got, err := config.PromotionRule(test.env)
+		if err != nil {
+			t.Errorf("PromotionRule(%s) returned an error: %s", test.env, err)
+		} else if got != test.want {
+			t.Errorf("PromotionRule(%s) = %+v, want %+v", test.env, got, test.want)
+		}
+	}
+}
+
+func TestPromotionRuleConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  PromotionConfig
+		want    PromotionRule
+		wantErr bool
+	}{
+		{
+			name:   "from defaults to pass",
+			config: PromotionConfig{From: "stage", Soak: Duration{time.Hour}},
+			want:   PromotionRule{Env: "prod", From: "stage", Kind: TagKindPass, Soak: time.Hour},
+		},
+		{
+			name:   "deploy",
+			config: PromotionConfig{From: "stage", Kind: "deploy", Registry: "123.dkr.ecr.us-west-2.amazonaws.com"},
+			want:   PromotionRule{Env: "prod", From: "stage", Kind: TagKindDeploy, Registry: "123.dkr.ecr.us-west-2.amazonaws.com"},
+		},
+		{
+			name:   "no from defaults to build",
+			config: PromotionConfig{},
+			want:   PromotionRule{Env: "prod", Kind: TagKindBuild},
+		},
+		{
+			name:   "build ignores from",
+			config: PromotionConfig{From: "stage", Kind: "build"},
+			want:   PromotionRule{Env: "prod", Kind: TagKindBuild},
+		},
+		{name: "pass needs from", config: PromotionConfig{Kind: "pass"}, wantErr: true},
+		{name: "deploy needs from", config: PromotionConfig{Kind: "deploy"}, wantErr: true},
+		{name: "from itself", config: PromotionConfig{From: "prod"}, wantErr: true},
+		{name: "fail kind", config: PromotionConfig{From: "stage", Kind: "fail"}, wantErr: true},
+		{name: "unknown kind", config: PromotionConfig{From: "stage", Kind: "tested"}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		config := Config{Promotion: map[string]PromotionConfig{"prod": test.config}}
+
+		got, err := config.PromotionRule("prod")
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("%s: PromotionRule = %+v, want an error", test.name, got)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: PromotionRule returned an error: %s", test.name, err)
+		} else if got != test.want {
+			t.Errorf("%s: PromotionRule = %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestPromotionRuleSoaked(t *testing.T) {
+	now := time.Date(2024, 1, 2, 12, 0, 0, 0, time.UTC)
+	rule := PromotionRule{Env: "prod", From: "stage", Kind: TagKindPass, Soak: time.Hour}
+
+	tests := []struct {
+		tag  Tag
+		want bool
+	}{
+		{NewTag(TagKindPass, "stage", now.Add(-2*time.Hour)), true},
+		{NewTag(TagKindPass, "stage", now.Add(-time.Hour)), true},
+		{NewTag(TagKindPass, "stage", now.Add(-59*time.Minute)), false},
+		{NewTag(TagKindPass, "stage", now), false},
+		// A tag from a host in another time zone is still the same instant
+		{NewTag(TagKindPass, "stage", now.Add(-2*time.Hour).In(time.FixedZone("UTC+5", 5*60*60))), true},
+	}
+
+	for _, test := range tests {
+		if got := rule.Soaked(test.tag, now); got != test.want {
+			t.Errorf("Soaked(%s) = %t, want %t", test.tag, got, test.want)
+		}
+	}
+}
+
+// Serves ListImages for a fake ECR repository holding the given tags.
+func fakeECR(t *testing.T, tags []string) (*session.Session, func()) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if target := r.Header.Get("X-Amz-Target"); target != "AmazonEC2ContainerRegistry_V20150921.ListImages" {
+			t.Errorf("Unexpected ECR request %s", target)
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+
+		var imageIds []map[string]string
+		for _, tag := range tags {
+			imageIds = append(imageIds, map[string]string{"imageDigest": "sha256:" + tag, "imageTag": tag})
+		}
+
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		json.NewEncoder(w).Encode(map[string]interface{}{"imageIds": imageIds})
+	}))
+
+	sess := session.New(aws.NewConfig().
+		WithRegion("us-east-1").
+		WithEndpoint(srv.URL).
+		WithCredentials(credentials.NewStaticCredentials("id", "secret", "")))
+
+	return sess, srv.Close
+}
+
+func TestFindPromotionCandidate(t *testing.T) {
+	now := time.Now()
+	soaked := NewTag(TagKindPass, "stage", now.Add(-3*time.Hour)).String()
+	newerSoaked := NewTag(TagKindPass, "stage", now.Add(-2*time.Hour)).String()
+	fresh := NewTag(TagKindPass, "stage", now.Add(-10*time.Minute)).String()
+
+	tags := []string{
+		newerSoaked,
+		fresh,
+		soaked,
+		"latest",
+		NewTag(TagKindBuild, "", now.Add(-4*time.Hour)).String(),
+		NewTag(TagKindFail, "stage", now.Add(-time.Hour)).String(),
+		NewTag(TagKindPass, "dev", now.Add(-time.Hour)).String(),
+	}
+
+	sess, cleanup := fakeECR(t, tags)
+	defer cleanup()
+
+	rule := PromotionRule{Env: "prod", From: "stage", Kind: TagKindPass}
+	tests := []struct {
+		soak    time.Duration
+		want    string
+		wantErr bool
+	}{
+		{soak: 0, want: fresh},
+		{soak: time.Hour, want: newerSoaked},
+		{soak: 150 * time.Minute, want: soaked},
+		{soak: 5 * time.Hour, wantErr: true},
+	}
+
+	for _, test := range tests {
+		rule.Soak = test.soak
+		got, err := FindPromotionCandidate("123.dkr.ecr.us-east-1.amazonaws.com", "app", rule, sess)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("FindPromotionCandidate with a %s soak = %s, want an error", test.soak, got)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("FindPromotionCandidate with a %s soak returned an error: %s", test.soak, err)
+		} else if got != test.want {
+			t.Errorf("FindPromotionCandidate with a %s soak = %s, want %s", test.soak, got, test.want)
+		}
+	}
+
+	rule = PromotionRule{Env: "prod", From: "qa", Kind: TagKindPass}
+	if got, err := FindPromotionCandidate("123.dkr.ecr.us-east-1.amazonaws.com", "app", rule, sess); err == nil {
+		t.Errorf("FindPromotionCandidate without matching tags = %s, want an error", got)
+	}
+}
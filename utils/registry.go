@@ -0,0 +1,577 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	MediaTypeManifestV1     = "application/vnd.docker.distribution.manifest.v1+prettyjws"
+	MediaTypeManifestV2     = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeManifestList   = "application/vnd.docker.distribution.manifest.list.v2+json"
+	MediaTypeOCIManifest    = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeOCIImageIndex  = "application/vnd.oci.image.index.v1+json"
+	dockerHubRegistryServer = "registry-1.docker.io"
+	registryTimeout         = 5 * time.Minute
+)
+
+var challengeParam = regexp.MustCompile(`(\w+)=(?:"([^"]*)"|([^,\s]*))`)
+
+// Client for the Docker Registry HTTP API V2. It talks to a registry directly
+// so images can be inspected without pulling them through the Docker daemon.
+type RegistryClient struct {
+	client *http.Client
+	host   string
+	auth   RegistryAuth
+	tokens map[string]string
+}
+
+// Error returned by a registry.
+type RegistryError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *RegistryError) Error() string {
+	return fmt.Sprintf("Registry returned %d: %s", e.StatusCode, e.Message)
+}
+
+// Checks if an error returned from a registry was caused by a missing image,
+// manifest or blob.
+func IsRegistryNotFound(err error) bool {
+	registryErr, ok := err.(*RegistryError)
+	return ok && registryErr.StatusCode == http.StatusNotFound
+}
+
+// Reference to content in a registry, such as an image config or a layer.
+type Descriptor struct {
+	MediaType string    `json:"mediaType"`
+	Size      int64     `json:"size"`
+	Digest    string    `json:"digest"`
+	URLs      []string  `json:"urls,omitempty"`
+	Platform  *Platform `json:"platform,omitempty"`
+}
+
+// Platform an image in a manifest list was built for.
+type Platform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+}
+
+// Image manifest, manifest list or OCI image index. Which fields are set
+// depends on the media type.
+type Manifest struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType,omitempty"`
+	Config        Descriptor   `json:"config"`
+	Layers        []Descriptor `json:"layers"`
+	Manifests     []Descriptor `json:"manifests"`
+	FSLayers      []struct {
+		BlobSum string `json:"blobSum"`
+	} `json:"fsLayers"`
+	History []struct {
+		V1Compatibility string `json:"v1Compatibility"`
+	} `json:"history"`
+}
+
+// Subset of an image's config blob.
+type ImageConfig struct {
+	Created string           `json:"created"`
+	Config  *ContainerConfig `json:"config"`
+}
+
+// Returns the label value for an image config.
+func (i *ImageConfig) Label(name string) string {
+	if i.Config == nil {
+		return ""
+	}
+	return i.Config.Labels[name]
+}
+
+// Creates a client for the registry at host. The credentials are used for
+// basic auth, or to get a token when the registry asks for one.
+func NewRegistryClient(host string, auth RegistryAuth) *RegistryClient {
+	if host == dockerIndexServer {
+		host = dockerHubRegistryServer
+	}
+
+	return &RegistryClient{
+		client: &http.Client{Timeout: registryTimeout},
+		host:   host,
+		auth:   auth,
+		tokens: make(map[string]string),
+	}
+}
+
+// Creates a client for the registry an image lives in. ECR registries are
+// logged in to with GetAuthorizationToken, other registries are used
+// anonymously.
+//
+// image -- Image repository, with or without a tag
+// profile -- AWS profile to use for ECR
+func GetRegistryClient(image, profile string) (*RegistryClient, error) {
+	return GetEnvRegistryClient(image, profile, EnvConfig{})
+}
+
+// Creates a client for the registry an image lives in, logging in to ECR
+// registries through the environment's role.
+//
+// image -- Image repository, with or without a tag
+// profile -- AWS profile used to assume the environment's role
+// env -- Settings for the environment
+func GetEnvRegistryClient(image, profile string, env EnvConfig) (*RegistryClient, error) {
+	host := registryHost(image)
+
+	var auth RegistryAuth
+	if getRegistryRegion(image) != "" {
+		var err error
+		auth, err = GetEnvEcrCredentials(profile, env, image)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return NewRegistryClient(host, auth), nil
+}
+
+// Splits an image name into the repository path within its registry and the
+// tag or digest.
+func RegistryRepository(image string) (string, string) {
+	repo, reference := SplitImageName(image)
+
+	if registryHost(repo) == dockerIndexServer {
+		repo = strings.TrimPrefix(repo, "docker.io/")
+		repo = strings.TrimPrefix(repo, "index.docker.io/")
+		if !strings.Contains(repo, "/") {
+			repo = "library/" + repo
+		}
+		return repo, reference
+	}
+
+	if i := strings.Index(repo, "/"); i >= 0 {
+		repo = repo[i+1:]
+	}
+	return repo, reference
+}
+
+func (c *RegistryClient) do(method, repo, path string, header http.Header, body io.Reader) (*http.Response, error) {
+	u := &url.URL{
+		Scheme: "https",
+		Host:   c.host,
+		Path:   fmt.Sprintf("/v2/%s/%s", repo, path),
+	}
+
+	return c.doURL(method, repo, u, header, body)
+}
+
+func (c *RegistryClient) doURL(method, repo string, u *url.URL, header http.Header, body io.Reader) (*http.Response, error) {
+	newRequest := func() (*http.Request, error) {
+		req, err := http.NewRequest(method, u.String(), body)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+
+		// Streamed bodies are otherwise sent chunked, which not every
+		// registry accepts for uploads
+		if size, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64); err == nil {
+			req.ContentLength = size
+		}
+
+		if token, ok := c.tokens[repo]; ok {
+			req.Header.Set("Authorization", "Bearer "+token)
+		} else if c.auth.Username != "" {
+			req.SetBasicAuth(c.auth.Username, c.auth.Password)
+		}
+		return req, nil
+	}
+
+	req, err := newRequest()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to reach registry %s: %s", c.host, err)
+	}
+
+	// Registries using token auth reject the first request and say where to
+	// get a token. Streamed bodies can't be replayed so those need a token
+	// from an earlier request.
+	seeker, replayable := body.(io.Seeker)
+	challenge := resp.Header.Get("WWW-Authenticate")
+	if resp.StatusCode == http.StatusUnauthorized && (body == nil || replayable) && strings.HasPrefix(challenge, "Bearer ") {
+		resp.Body.Close()
+
+		token, err := c.fetchToken(challenge)
+		if err != nil {
+			return nil, err
+		}
+		c.tokens[repo] = token
+
+		if replayable {
+			if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+				return nil, err
+			}
+		}
+
+		req, err = newRequest()
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err = c.client.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to reach registry %s: %s", c.host, err)
+		}
+	}
+
+	if resp.StatusCode >= 400 {
+		defer resp.Body.Close()
+		return nil, readRegistryError(resp)
+	}
+
+	return resp, nil
+}
+
+// Gets a bearer token from the realm in a WWW-Authenticate challenge.
+func (c *RegistryClient) fetchToken(challenge string) (string, error) {
+	// Quoted values such as the scope "repository:app:pull,push" can hold
+	// commas, so the parameters can't just be split on them
+	params := make(map[string]string)
+	for _, match := range challengeParam.FindAllStringSubmatch(strings.TrimPrefix(challenge, "Bearer "), -1) {
+		params[match[1]] = match[2]
+		if match[3] != "" {
+			params[match[1]] = match[3]
+		}
+	}
+
+	realm, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return "", fmt.Errorf("Registry %s sent an invalid auth challenge: %s", c.host, challenge)
+	}
+
+	query := realm.Query()
+	for _, key := range []string{"service", "scope"} {
+		if params[key] != "" {
+			query.Set(key, params[key])
+		}
+	}
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequest("GET", realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if c.auth.Username != "" {
+		req.SetBasicAuth(c.auth.Username, c.auth.Password)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("Unable to get a token for registry %s: %s", c.host, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return "", readRegistryError(resp)
+	}
+
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", fmt.Errorf("Unable to read token for registry %s: %s", c.host, err)
+	}
+
+	if token.Token != "" {
+		return token.Token, nil
+	}
+	return token.AccessToken, nil
+}
+
+func readRegistryError(resp *http.Response) error {
+	var apiErr struct {
+		Errors []struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+
+	data, _ := ioutil.ReadAll(resp.Body)
+	if err := json.Unmarshal(data, &apiErr); err != nil || len(apiErr.Errors) == 0 {
+		message := strings.TrimSpace(string(data))
+		if message == "" {
+			message = http.StatusText(resp.StatusCode)
+		}
+		return &RegistryError{StatusCode: resp.StatusCode, Message: message}
+	}
+
+	var messages []string
+	for _, e := range apiErr.Errors {
+		messages = append(messages, fmt.Sprintf("%s: %s", e.Code, e.Message))
+	}
+
+	return &RegistryError{StatusCode: resp.StatusCode, Message: strings.Join(messages, ", ")}
+}
+
+// Fetches a manifest by tag or digest. Returns the parsed manifest along with
+// the raw manifest and its media type, which are needed to push it unchanged.
+//
+// repo -- Repository path within the registry
+// reference -- Tag or digest of the manifest
+func (c *RegistryClient) GetManifest(repo, reference string) (*Manifest, []byte, string, error) {
+	header := http.Header{}
+	header.Set("Accept", strings.Join([]string{
+		MediaTypeManifestV2,
+		MediaTypeManifestList,
+		MediaTypeOCIManifest,
+		MediaTypeOCIImageIndex,
+		MediaTypeManifestV1,
+	}, ", "))
+
+	resp, err := c.do("GET", repo, "manifests/"+reference, header, nil)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, nil, "", fmt.Errorf("Unable to read manifest %s:%s: %s", repo, reference, err)
+	}
+
+	mediaType := strings.TrimSpace(strings.Split(resp.Header.Get("Content-Type"), ";")[0])
+	if manifest.MediaType != "" {
+		mediaType = manifest.MediaType
+	}
+
+	return &manifest, data, mediaType, nil
+}
+
+// Fetches a blob such as a layer or an image config. The caller must close
+// the returned reader.
+//
+// repo -- Repository path within the registry
+// digest -- Digest of the blob
+func (c *RegistryClient) GetBlob(repo, digest string) (io.ReadCloser, error) {
+	resp, err := c.do("GET", repo, "blobs/"+digest, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+// Looks up the config of an image, which holds its labels. Manifest lists are
+// resolved to their linux/amd64 image.
+//
+// repo -- Repository path within the registry
+// reference -- Tag or digest of the image
+func (c *RegistryClient) GetImageConfig(repo, reference string) (*ImageConfig, error) {
+	manifest, _, mediaType, err := c.GetManifest(repo, reference)
+	if err != nil {
+		return nil, err
+	}
+
+	if mediaType == MediaTypeManifestList || mediaType == MediaTypeOCIImageIndex {
+		digest := ""
+		for _, m := range manifest.Manifests {
+			if m.Platform == nil || (m.Platform.OS == "linux" && m.Platform.Architecture == "amd64") {
+				digest = m.Digest
+				break
+			}
+		}
+		if digest == "" {
+			return nil, fmt.Errorf("No linux/amd64 image found for %s:%s", repo, reference)
+		}
+		return c.GetImageConfig(repo, digest)
+	}
+
+	var config ImageConfig
+
+	// Schema 1 manifests carry the image config in their history instead of
+	// in a separate blob.
+	if manifest.SchemaVersion == 1 {
+		if len(manifest.History) == 0 {
+			return nil, fmt.Errorf("Manifest for %s:%s has no history", repo, reference)
+		}
+		if err := json.Unmarshal([]byte(manifest.History[0].V1Compatibility), &config); err != nil {
+			return nil, fmt.Errorf("Unable to read image config for %s:%s: %s", repo, reference, err)
+		}
+		return &config, nil
+	}
+
+	blob, err := c.GetBlob(repo, manifest.Config.Digest)
+	if err != nil {
+		return nil, err
+	}
+	defer blob.Close()
+
+	if err := json.NewDecoder(blob).Decode(&config); err != nil {
+		return nil, fmt.Errorf("Unable to read image config for %s:%s: %s", repo, reference, err)
+	}
+
+	return &config, nil
+}
+
+// Looks up the config of an image straight from its registry without pulling
+// it.
+//
+// image -- Full image name including the registry and the tag
+// profile -- AWS profile to use for ECR
+func GetRemoteImageConfig(image, profile string) (*ImageConfig, error) {
+	client, err := GetRegistryClient(image, profile)
+	if err != nil {
+		return nil, err
+	}
+
+	repo, reference := RegistryRepository(image)
+	return client.GetImageConfig(repo, reference)
+}
+
+// Reports whether an image is in its registry without pulling it.
+//
+// image -- Full image name including the registry and the tag
+// profile -- AWS profile to use for ECR
+func RemoteImageExists(image, profile string) (bool, error) {
+	client, err := GetRegistryClient(image, profile)
+	if err != nil {
+		return false, err
+	}
+
+	repo, reference := RegistryRepository(image)
+	_, _, _, err = client.GetManifest(repo, reference)
+	if IsRegistryNotFound(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Reports whether a registry already has a blob.
+//
+// repo -- Repository path within the registry
+// digest -- Digest of the blob
+func (c *RegistryClient) BlobExists(repo, digest string) (bool, error) {
+	resp, err := c.do("HEAD", repo, "blobs/"+digest, nil, nil)
+	if IsRegistryNotFound(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	return true, nil
+}
+
+// Uploads a blob. The registry checks the content against the digest when the
+// upload finishes.
+//
+// repo -- Repository path within the registry
+// digest -- Digest of the blob
+// size -- Size of the blob in bytes, or -1 if it isn't known
+// content -- Content of the blob
+func (c *RegistryClient) PutBlob(repo, digest string, size int64, content io.Reader) error {
+	// Starting the upload has no body, so registries using token auth can
+	// hand out a token with push access here
+	resp, err := c.do("POST", repo, "blobs/uploads/", nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	location, err := c.uploadLocation(resp)
+	if err != nil {
+		return err
+	}
+
+	header := http.Header{}
+	header.Set("Content-Type", "application/octet-stream")
+	if size >= 0 {
+		header.Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+
+	resp, err = c.doURL("PATCH", repo, location, header, content)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if location, err = c.uploadLocation(resp); err != nil {
+		return err
+	}
+
+	query := location.Query()
+	query.Set("digest", digest)
+	location.RawQuery = query.Encode()
+
+	header = http.Header{}
+	header.Set("Content-Length", "0")
+
+	resp, err = c.doURL("PUT", repo, location, header, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// Returns where an upload continues, which registries may give relative to
+// themselves.
+func (c *RegistryClient) uploadLocation(resp *http.Response) (*url.URL, error) {
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return nil, fmt.Errorf("Registry %s did not say where to upload to", c.host)
+	}
+
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, fmt.Errorf("Registry %s sent an invalid upload location: %s", c.host, err)
+	}
+
+	base := &url.URL{Scheme: "https", Host: c.host}
+	return base.ResolveReference(u), nil
+}
+
+// Uploads a manifest under a tag or digest. Returns the digest the registry
+// stored the manifest as.
+//
+// repo -- Repository path within the registry
+// reference -- Tag or digest to store the manifest under
+// mediaType -- Media type of the manifest
+// data -- Raw manifest, exactly as it was fetched
+func (c *RegistryClient) PutManifest(repo, reference, mediaType string, data []byte) (string, error) {
+	header := http.Header{}
+	header.Set("Content-Type", mediaType)
+	header.Set("Content-Length", strconv.Itoa(len(data)))
+
+	resp, err := c.do("PUT", repo, "manifests/"+reference, header, bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+
+	return resp.Header.Get("Docker-Content-Digest"), nil
+}
@@ -0,0 +1,149 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	s3URIScheme = "s3://"
+
+	// Largest template Cloudformation accepts as a TemplateBody
+	MaxTemplateBodySize = 51200
+)
+
+// Splits an s3://bucket/key URI into its bucket and key.
+func ParseS3URI(uri string) (string, string, error) {
+	if !strings.HasPrefix(uri, s3URIScheme) {
+		return "", "", fmt.Errorf("%s is not an s3:// URI", uri)
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(uri, s3URIScheme), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("%s is not of the form s3://<bucket>/<key>", uri)
+	}
+
+	return parts[0], parts[1], nil
+}
+
+// Returns true if the given location is an s3:// URI.
+func IsS3URI(location string) bool {
+	return strings.HasPrefix(location, s3URIScheme)
+}
+
+// Returns the https URL of an object in S3. Path style URLs are used so
+// bucket names containing dots still work over TLS.
+//
+// bucket -- Name of the bucket
+// key -- Key of the object
+// region -- Region the bucket is in
+func S3ObjectURL(bucket, key, region string) string {
+	host := "s3.amazonaws.com"
+	if region != "" && region != "us-east-1" {
+		host = fmt.Sprintf("s3.%s.amazonaws.com", region)
+	}
+
+	u := url.URL{
+		Scheme: "https",
+		Host:   host,
+		Path:   "/" + bucket + "/" + key,
+	}
+
+	return u.String()
+}
+
+// Looks up the region a bucket was created in.
+func GetBucketRegion(bucket string, s3Client *s3.S3) (string, error) {
+	resp, err := s3Client.GetBucketLocation(&s3.GetBucketLocationInput{
+		Bucket: aws.String(bucket),
+	})
+	if err != nil {
+		return "", fmt.Errorf("Unable to look up the region of bucket %s: %s", bucket, err)
+	}
+
+	// Buckets in us-east-1 have no location constraint and old buckets in
+	// eu-west-1 use the legacy name EU.
+	switch location := aws.StringValue(resp.LocationConstraint); location {
+	case "":
+		return "us-east-1", nil
+	case "EU":
+		return "eu-west-1", nil
+	default:
+		return location, nil
+	}
+}
+
+// Converts an s3://bucket/key URI into the object's https URL.
+func S3URIToURL(uri string, sess *session.Session) (string, error) {
+	bucket, key, err := ParseS3URI(uri)
+	if err != nil {
+		return "", err
+	}
+
+	region, err := GetBucketRegion(bucket, s3.New(sess))
+	if err != nil {
+		return "", err
+	}
+
+	return S3ObjectURL(bucket, key, region), nil
+}
+
+// Returns a key for an artifact that is based on its contents, so uploading
+// the same contents twice ends up at the same key.
+//
+// prefix -- Prefix for the key, usually the name of the service
+// name -- File name of the artifact. Only the extension is kept
+// contents -- Contents of the artifact
+func ArtifactKey(prefix, name string, contents []byte) string {
+	sum := sha256.Sum256(contents)
+	return path.Join(prefix, hex.EncodeToString(sum[:])+path.Ext(name))
+}
+
+// Uploads an artifact to S3 unless an object already exists at the key.
+// Returns the https URL of the object.
+//
+// bucket -- Name of the bucket to upload to
+// key -- Key to upload the artifact to
+// contents -- Contents of the artifact
+// sess -- AWS session to use. The bucket may be in any region
+func UploadArtifact(bucket, key string, contents []byte, sess *session.Session) (string, error) {
+	region, err := GetBucketRegion(bucket, s3.New(sess))
+	if err != nil {
+		return "", err
+	}
+
+	s3Client := s3.New(sess, aws.NewConfig().WithRegion(region))
+
+	// A missing object is reported as forbidden when the bucket can't be
+	// listed, so the upload is still attempted in that case.
+	_, err = s3Client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err == nil {
+		return S3ObjectURL(bucket, key, region), nil
+	} else if aerr, ok := err.(awserr.RequestFailure); !ok || (aerr.StatusCode() != 404 && aerr.StatusCode() != 403) {
+		return "", fmt.Errorf("Unable to check for s3://%s/%s: %s", bucket, key, err)
+	}
+
+	_, err = s3Client.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(contents),
+	})
+	if err != nil {
+		return "", fmt.Errorf("Unable to upload to s3://%s/%s: %s", bucket, key, err)
+	}
+
+	return S3ObjectURL(bucket, key, region), nil
+}
@@ -0,0 +1,168 @@
+package utils
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The kind of image a tag marks.
+type TagKind string
+
+const (
+	TagKindBuild   TagKind = "build"   // Built from the repository, of the form <time>
+	TagKindPass    TagKind = "pass"    // Passed in an environment, of the form <env>-pass-<time>
+	TagKindFail    TagKind = "fail"    // Failed in an environment, of the form <env>-fail-<time>
+	TagKindDeploy  TagKind = "deploy"  // Deployed to an environment, of the form <env>-deploy-<time>
+	TagKindPreview TagKind = "preview" // Built for a preview environment, of the form <env>-preview-<time>
+
+	// Marks the time of a tag as UTC
+	tagUTCMarker = "Z"
+)
+
+var tagTimestamp = regexp.MustCompile(`^([0-9]{10})(Z?)(?:\.([1-9][0-9]*))?$`)
+
+// Reports whether the kind is one build_tool knows about.
+func (k TagKind) Valid() bool {
+	switch k {
+	case TagKindBuild, TagKindPass, TagKindFail, TagKindDeploy, TagKindPreview:
+		return true
+	}
+	return false
+}
+
+// An image tag created by build_tool. The time is kept to the minute in UTC,
+// marked with a Z, so tags from hosts in different time zones compare
+// correctly. Tags created within the same minute are told apart by their
+// sequence number, which is left out of the tag when it's 0.
+//
+// Tags from before times were kept in UTC have no Z. Their time is in the
+// time zone of the host that created them, which is taken to be the local
+// time zone, so they still sort in with newer tags when build_tool runs on
+// the same hosts.
+type Tag struct {
+	Kind  TagKind
+	Env   string
+	Time  time.Time
+	Seq   int
+	Local bool // The time was created in the local time zone, without a Z
+}
+
+// Creates a tag for the minute the time falls in.
+//
+// kind -- Kind of tag to create
+// env -- Environment the tag is for. Ignored for build tags
+// t -- Time of the tag
+func NewTag(kind TagKind, env string, t time.Time) Tag {
+	if kind == TagKindBuild {
+		env = ""
+	}
+	return Tag{Kind: kind, Env: env, Time: t.UTC().Truncate(time.Minute)}
+}
+
+// Returns the first tag after all the existing tags with the same kind,
+// environment and time.
+//
+// existing -- Tags already in use
+func (t Tag) Next(existing []Tag) Tag {
+	next := t
+	for _, other := range existing {
+		if other.Kind == t.Kind && other.Env == t.Env && other.Local == t.Local && other.Time.Equal(t.Time) && other.Seq >= next.Seq {
+			next.Seq = other.Seq + 1
+		}
+	}
+	return next
+}
+
+func (t Tag) String() string {
+	stamp := t.Time.UTC().Format(BuildDateFormat) + tagUTCMarker
+	if t.Local {
+		stamp = t.Time.Local().Format(BuildDateFormat)
+	}
+	if t.Seq > 0 {
+		stamp = fmt.Sprintf("%s.%d", stamp, t.Seq)
+	}
+
+	if t.Kind == TagKindBuild {
+		return stamp
+	}
+	return fmt.Sprintf("%s-%s-%s", t.Env, t.Kind, stamp)
+}
+
+// Reports whether the tag was created before another. Tags from the same
+// minute are ordered by their sequence.
+func (t Tag) Before(other Tag) bool {
+	if !t.Time.Equal(other.Time) {
+		return t.Time.Before(other.Time)
+	}
+	if t.Seq != other.Seq {
+		return t.Seq < other.Seq
+	}
+	return t.String() < other.String()
+}
+
+// Parses a tag created by build_tool. The environment may contain dashes, so
+// the tag is read from the end.
+//
+// tag -- Tag to parse
+func ParseTag(tag string) (Tag, error) {
+	var t Tag
+
+	stamp := tag
+	if i := strings.LastIndex(tag, "-"); i >= 0 {
+		stamp = tag[i+1:]
+
+		prefix := tag[:i]
+		j := strings.LastIndex(prefix, "-")
+		if j <= 0 {
+			return Tag{}, fmt.Errorf("Tag %s is not of the form <env>-<kind>-<time>", tag)
+		}
+		t.Env = prefix[:j]
+		t.Kind = TagKind(prefix[j+1:])
+
+		if t.Kind == TagKindBuild || !t.Kind.Valid() {
+			return Tag{}, fmt.Errorf("Tag %s has an unknown kind %s", tag, t.Kind)
+		}
+	} else {
+		t.Kind = TagKindBuild
+	}
+
+	match := tagTimestamp.FindStringSubmatch(stamp)
+	if match == nil {
+		return Tag{}, fmt.Errorf("Tag %s does not end in a time of the form %s%s", tag, BuildDateFormat, tagUTCMarker)
+	}
+
+	location := time.UTC
+	if match[2] != tagUTCMarker {
+		t.Local = true
+		location = time.Local
+	}
+
+	var err error
+	if t.Time, err = time.ParseInLocation(BuildDateFormat, match[1], location); err != nil {
+		return Tag{}, fmt.Errorf("Tag %s has an invalid time: %s", tag, err)
+	}
+
+	if match[3] != "" {
+		if t.Seq, err = strconv.Atoi(match[3]); err != nil {
+			return Tag{}, fmt.Errorf("Tag %s has an invalid sequence: %s", tag, err)
+		}
+	}
+
+	// Times that don't exist, like the 32nd of a month, don't survive the
+	// round trip
+	if t.String() != tag {
+		return Tag{}, fmt.Errorf("Tag %s is not a valid tag", tag)
+	}
+
+	return t, nil
+}
+
+// Reports whether a string can be used as a docker tag.
+//
+// tag -- Tag to check
+func ValidDockerTag(tag string) bool {
+	return tag != "" && len(tag) <= maxDockerTagLength && sanitizeDockerTag(tag) == tag
+}
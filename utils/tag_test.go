@@ -0,0 +1,232 @@
+package utils
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+)
+
+func tagTime(year int, month time.Month, day, hour, min int) time.Time {
+	return time.Date(year, month, day, hour, min, 0, 0, time.UTC)
+}
+
+func mustParseTag(t *testing.T, tag string) Tag {
+	parsed, err := ParseTag(tag)
+	if err != nil {
+		t.Fatalf("ParseTag(%q) returned an error: %s", tag, err)
+	}
+	return parsed
+}
+
+// Sets the local time zone for a test. Returns a function putting the
+// original one back.
+func setLocalZone(offsetHours int) func() {
+	local := time.Local
+	time.Local = time.FixedZone("test", offsetHours*60*60)
+	return func() { time.Local = local }
+}
+
+func TestParseTag(t *testing.T) {
+	defer setLocalZone(-7)()
+	localTime := func(year int, month time.Month, day, hour, min int) time.Time {
+		return time.Date(year, month, day, hour, min, 0, 0, time.Local)
+	}
+
+	tests := []struct {
+		tag     string
+		want    Tag
+		wantErr bool
+	}{
+		{tag: "2401020304Z", want: Tag{Kind: TagKindBuild, Time: tagTime(2024, 1, 2, 3, 4)}},
+		{tag: "2401020304Z.2", want: Tag{Kind: TagKindBuild, Time: tagTime(2024, 1, 2, 3, 4), Seq: 2}},
+		{tag: "2401020304Z.10", want: Tag{Kind: TagKindBuild, Time: tagTime(2024, 1, 2, 3, 4), Seq: 10}},
+		{tag: "stage-pass-2401020304Z", want: Tag{Kind: TagKindPass, Env: "stage", Time: tagTime(2024, 1, 2, 3, 4)}},
+		{tag: "prod-fail-2312312359Z", want: Tag{Kind: TagKindFail, Env: "prod", Time: tagTime(2023, 12, 31, 23, 59)}},
+		{tag: "my-app-stage-deploy-2401020304Z.3", want: Tag{Kind: TagKindDeploy, Env: "my-app-stage", Time: tagTime(2024, 1, 2, 3, 4), Seq: 3}},
+		{tag: "pr-12-preview-2401020304Z", want: Tag{Kind: TagKindPreview, Env: "pr-12", Time: tagTime(2024, 1, 2, 3, 4)}},
+
+		// Tags from before the marker are in local time
+		{tag: "2401020304", want: Tag{Kind: TagKindBuild, Time: localTime(2024, 1, 2, 3, 4), Local: true}},
+		{tag: "2401020304.2", want: Tag{Kind: TagKindBuild, Time: localTime(2024, 1, 2, 3, 4), Seq: 2, Local: true}},
+		{tag: "stage-pass-2401020304", want: Tag{Kind: TagKindPass, Env: "stage", Time: localTime(2024, 1, 2, 3, 4), Local: true}},
+
+		{tag: "", wantErr: true},
+		{tag: "latest", wantErr: true},
+		{tag: "Z", wantErr: true},
+		{tag: "12345", wantErr: true},
+		{tag: "240102030", wantErr: true},
+		{tag: "24010203045", wantErr: true},
+		{tag: "1713321599", wantErr: true},
+		{tag: "2402300000Z", wantErr: true},
+		{tag: "2401020304z", wantErr: true},
+		{tag: "2401020304ZZ", wantErr: true},
+		{tag: "2401020304.1Z", wantErr: true},
+		{tag: "2401020304Z.0", wantErr: true},
+		{tag: "2401020304Z.01", wantErr: true},
+		{tag: "2401020304Z.", wantErr: true},
+		{tag: "stage-pass-", wantErr: true},
+		{tag: "stage-pass-2401020304Z.0", wantErr: true},
+		{tag: "pass-2401020304Z", wantErr: true},
+		{tag: "-pass-2401020304Z", wantErr: true},
+		{tag: "stage-build-2401020304Z", wantErr: true},
+		{tag: "stage-unknown-2401020304Z", wantErr: true},
+	}
+
+	for _, test := range tests {
+		got, err := ParseTag(test.tag)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("ParseTag(%q) = %+v, want an error", test.tag, got)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("ParseTag(%q) returned an error: %s", test.tag, err)
+			continue
+		}
+		if got.Kind != test.want.Kind || got.Env != test.want.Env || !got.Time.Equal(test.want.Time) || got.Seq != test.want.Seq || got.Local != test.want.Local {
+			t.Errorf("ParseTag(%q) = %+v, want %+v", test.tag, got, test.want)
+		}
+		if got.String() != test.tag {
+			t.Errorf("ParseTag(%q).String() = %q", test.tag, got.String())
+		}
+	}
+}
+
+func TestTagBefore(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"2401020304Z", "2401020305Z", true},
+		{"2401020305Z", "2401020304Z", false},
+		{"2401020304Z.5", "2401020305Z", true},
+		{"2401020305Z", "2401020304Z.5", false},
+		{"2312312359Z", "2401010000Z", true},
+		{"2401020304Z", "2401020304Z.1", true},
+		{"2401020304Z.1", "2401020304Z.2", true},
+		{"2401020304Z.2", "2401020304Z.10", true},
+		{"2401020304Z.10", "2401020304Z.2", false},
+		{"2401020304Z", "2401020304Z", false},
+		{"stage-pass-2401020304Z", "stage-pass-2401020304Z.1", true},
+		{"stage-pass-2401020304Z.1", "stage-deploy-2401020305Z", true},
+		{"prod-pass-2401020304Z", "stage-pass-2401020304Z", true},
+		{"stage-pass-2401020304Z", "prod-pass-2401020304Z", false},
+	}
+
+	for _, test := range tests {
+		a, b := mustParseTag(t, test.a), mustParseTag(t, test.b)
+		if got := a.Before(b); got != test.want {
+			t.Errorf("%s.Before(%s) = %t, want %t", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+// Tags created around the switch to UTC still sort by when they were created
+// on a host seven hours behind UTC, which wrote 10:00 UTC as 0300.
+func TestTagBeforeAcrossUTCSwitch(t *testing.T) {
+	defer setLocalZone(-7)()
+
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		// 03:00 local is 10:00 UTC
+		{"stage-pass-2401020300", "stage-pass-2401021001Z", true},
+		{"stage-pass-2401020300", "stage-pass-2401020959Z", false},
+		{"stage-pass-2401020959Z", "stage-pass-2401020300", true},
+		{"2401020300.3", "2401021001Z", true},
+		{"2401021001Z", "2401020300.3", false},
+		{"2401020259", "2401020300", true},
+	}
+
+	for _, test := range tests {
+		a, b := mustParseTag(t, test.a), mustParseTag(t, test.b)
+		if got := a.Before(b); got != test.want {
+			t.Errorf("%s.Before(%s) = %t, want %t", test.a, test.b, got, test.want)
+		}
+	}
+
+	// The latest tag is the newest whichever form it's in
+	var images byTag
+	for _, tag := range []string{"stage-pass-2401020959Z", "stage-pass-2401020301", "stage-pass-2401020200", "stage-pass-2401021002Z"} {
+		images.images = append(images.images, &ecr.ImageIdentifier{ImageTag: aws.String(tag)})
+		images.tags = append(images.tags, mustParseTag(t, tag))
+	}
+	sort.Sort(images)
+
+	want := []string{"stage-pass-2401020200", "stage-pass-2401020959Z", "stage-pass-2401020301", "stage-pass-2401021002Z"}
+	for i, image := range images.images {
+		if aws.StringValue(image.ImageTag) != want[i] {
+			t.Errorf("Sorted tags = %v, want %v", images.tags, want)
+			break
+		}
+	}
+
+	// A tag that would have soaked for an hour going by its digits alone
+	rule := PromotionRule{Env: "prod", From: "stage", Kind: TagKindPass, Soak: time.Hour}
+	now := tagTime(2024, 1, 2, 10, 30)
+	if rule.Soaked(mustParseTag(t, "stage-pass-2401020300"), now) {
+		t.Errorf("stage-pass-2401020300 from 10:00 UTC has soaked for an hour at 10:30 UTC")
+	}
+	if !rule.Soaked(mustParseTag(t, "stage-pass-2401020200"), now) {
+		t.Errorf("stage-pass-2401020200 from 09:00 UTC hasn't soaked for an hour at 10:30 UTC")
+	}
+}
+
+func TestTagNext(t *testing.T) {
+	tests := []struct {
+		tag      Tag
+		existing []string
+		want     string
+	}{
+		{NewTag(TagKindBuild, "", tagTime(2024, 1, 2, 3, 4)), nil, "2401020304Z"},
+		{NewTag(TagKindBuild, "stage", tagTime(2024, 1, 2, 3, 4)), nil, "2401020304Z"},
+		{NewTag(TagKindBuild, "", time.Date(2024, 1, 2, 3, 4, 59, 0, time.UTC)), []string{"2401020303Z", "2401020305Z"}, "2401020304Z"},
+		{NewTag(TagKindBuild, "", tagTime(2024, 1, 2, 3, 4)), []string{"2401020304Z"}, "2401020304Z.1"},
+		{NewTag(TagKindBuild, "", tagTime(2024, 1, 2, 3, 4)), []string{"2401020304Z.3", "2401020304Z", "2401020304Z.1"}, "2401020304Z.4"},
+		{NewTag(TagKindPass, "stage", tagTime(2024, 1, 2, 3, 4)), []string{"2401020304Z", "prod-pass-2401020304Z", "stage-fail-2401020304Z"}, "stage-pass-2401020304Z"},
+		{NewTag(TagKindPass, "stage", tagTime(2024, 1, 2, 3, 4)), []string{"stage-pass-2401020304Z.2"}, "stage-pass-2401020304Z.3"},
+		{NewTag(TagKindDeploy, "my-app-stage", tagTime(2024, 1, 2, 3, 4)), []string{"my-app-stage-deploy-2401020304Z", "app-stage-deploy-2401020304Z.5"}, "my-app-stage-deploy-2401020304Z.1"},
+	}
+
+	for _, test := range tests {
+		var existing []Tag
+		for _, tag := range test.existing {
+			existing = append(existing, mustParseTag(t, tag))
+		}
+
+		next := test.tag.Next(existing)
+		if got := next.String(); got != test.want {
+			t.Errorf("%s.Next(%v) = %s, want %s", test.tag, test.existing, got, test.want)
+		}
+	}
+}
+
+func TestTagNextIgnoresLocalTags(t *testing.T) {
+	defer setLocalZone(0)()
+
+	// An old tag from the same minute can't clash with the new one
+	tag := NewTag(TagKindPass, "stage", tagTime(2024, 1, 2, 3, 4))
+	existing := []Tag{mustParseTag(t, "stage-pass-2401020304"), mustParseTag(t, "stage-pass-2401020304.1")}
+
+	if got := tag.Next(existing).String(); got != "stage-pass-2401020304Z" {
+		t.Errorf("%s.Next(%v) = %s, want stage-pass-2401020304Z", tag, existing, got)
+	}
+}
+
+func TestNewTagUsesUTC(t *testing.T) {
+	zone := time.FixedZone("UTC-7", -7*60*60)
+	tag := NewTag(TagKindPass, "stage", time.Date(2024, 1, 1, 20, 30, 15, 0, zone))
+
+	if got, want := tag.String(), "stage-pass-2401020330Z"; got != want {
+		t.Errorf("NewTag in UTC-7 = %s, want %s", got, want)
+	}
+	if !tag.Time.Equal(mustParseTag(t, tag.String()).Time) {
+		t.Errorf("ParseTag(%s) doesn't give back the tag's time", tag)
+	}
+}
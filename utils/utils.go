@@ -1,11 +1,14 @@
 package utils
 
 import (
+	"bufio"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"os/signal"
 	"strings"
-	"time"
+	"sync"
+	"syscall"
 )
 
 const (
@@ -16,14 +19,21 @@ const (
 	BuildDateLabel = "com.katch.build_date"
 	CommitLabel    = "com.katch.commit"
 
-	TagDeployFmt = "%s-deploy"
-	TagPassFmt   = "%s-pass"
-	TagFailFmt   = "%s-fail"
+	CIProviderLabel    = "com.katch.ci.provider"
+	CIBranchLabel      = "com.katch.ci.branch"
+	CIPullRequestLabel = "com.katch.ci.pull_request"
+	CIURLLabel         = "com.katch.ci.url"
+	CIUserLabel        = "com.katch.ci.user"
+)
+
+// Exit code used when the program is stopped by an interrupt or SIGTERM
+const ExitCodeInterrupted = 130
 
-	TagDeployRegex  = "^%s-deploy-[0-9]*$"
-	TagPassRegex    = "^%s-pass-[0-9]*$"
-	TagFailRegex    = "^%s-fail-[0-9]*$"
-	TagDefaultRegex = "^[0-9]*$"
+var (
+	exitHooks     []func()
+	exitHooksLock sync.Mutex
+	catchSignals  sync.Once
+	exitCode      int
 )
 
 // Print out an error and then quit with the given exit code.
@@ -33,7 +43,56 @@ func ErrorAndQuit(msg string, err error, exitCode int) {
 	} else {
 		fmt.Fprintf(os.Stderr, "%s\n", msg)
 	}
-	os.Exit(exitCode)
+	Exit(exitCode)
+}
+
+// Registers a function to run before the program exits through Exit,
+// ErrorAndQuit or an interrupt. Hooks run in the reverse order they were
+// added. Used to clean up things like deploy locks that must not outlive the
+// process.
+func AtExit(hook func()) {
+	exitHooksLock.Lock()
+	exitHooks = append(exitHooks, hook)
+	exitHooksLock.Unlock()
+
+	catchSignals.Do(func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			sig := <-signals
+			fmt.Fprintf(os.Stderr, "Received %s, cleaning up\n", sig)
+			Exit(ExitCodeInterrupted)
+		}()
+	})
+}
+
+// Runs the exit hooks and then quits with the given exit code.
+func Exit(code int) {
+	exitHooksLock.Lock()
+	exitCode = code
+	exitHooksLock.Unlock()
+
+	runExitHooks()
+	os.Exit(code)
+}
+
+// Returns the code the program is quitting with, for exit hooks that behave
+// differently on an interrupt. It's 0 until Exit is called.
+func ExitCode() int {
+	exitHooksLock.Lock()
+	defer exitHooksLock.Unlock()
+	return exitCode
+}
+
+func runExitHooks() {
+	exitHooksLock.Lock()
+	hooks := exitHooks
+	exitHooks = nil
+	exitHooksLock.Unlock()
+
+	for i := len(hooks) - 1; i >= 0; i-- {
+		hooks[i]()
+	}
 }
 
 // Check to see if the program is currently running at the top-level of
@@ -91,32 +150,10 @@ func GetEnvSettings() (map[string]string, error) {
 
 // Generates a Docker job tag when running in a CI environment.
 func GetDockerJobTag() string {
-	var dockerTag string
-	if os.Getenv("JOB_NAME") != "" && os.Getenv("BUILD_NUMBER") != "" {
-		dockerTag = strings.Join([]string{os.Getenv("JOB_NAME"), os.Getenv("BUILD_NUMBER")}, "-")
-		dockerTag = strings.Replace(dockerTag, "/", "_", -1)
-		dockerTag = strings.Replace(dockerTag, "%2F", "_", -1)
-	} else {
-		dockerTag = defaultTag
+	if tag := DetectCI().JobTag; tag != "" {
+		return tag
 	}
-	return dockerTag
-}
-
-// Creates a default set of tags with the given input
-func CreateTag(env, date string, successful, failure, deploy bool) string {
-	if date == "" {
-		date = time.Now().Format(BuildDateFormat)
-	}
-
-	if deploy {
-		return fmt.Sprintf("%s-%s", fmt.Sprintf(TagDeployFmt, env), date)
-	} else if successful {
-		return fmt.Sprintf("%s-%s", fmt.Sprintf(TagPassFmt, env), date)
-	} else if failure {
-		return fmt.Sprintf("%s-%s", fmt.Sprintf(TagFailFmt, env), date)
-	}
-
-	return date
+	return defaultTag
 }
 
 // Returns the name of a Task based on the environment and stack.
@@ -133,3 +170,17 @@ func GetCommitLabel() (string, error) {
 
 	return fmt.Sprintf("%s=%s", CommitLabel, headSHA), nil
 }
+
+// Asks the user a yes or no question on STDERR and reads the answer from
+// STDIN. Anything other than y or yes is treated as no.
+func Confirm(question string) bool {
+	fmt.Fprintf(os.Stderr, "%s [y/N]: ", question)
+
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return false
+	}
+
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}